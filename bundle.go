@@ -0,0 +1,373 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// A provisioning bundle is a zip archive holding a manifest.json file
+// and the files it names.  The manifest names the radio model and
+// gives the name and SHA-256 of each file present:
+//
+//	{
+//		"model": "MD380",
+//		"firmware": {"name": "firmware.bin", "sha256": "..."},
+//		"codeplug": {"name": "codeplug.bin", "sha256": "..."},
+//		"users": {"name": "users.bin", "sha256": "..."}
+//	}
+//
+// Each of firmware, codeplug and users is optional.  Since the
+// manifest holds the hash of every file, a signature over the manifest
+// covers the whole bundle.
+const bundleManifestName = "manifest.json"
+
+type bundleManifest struct {
+	Model    string      `json:"model"`
+	Firmware *bundleFile `json:"firmware,omitempty"`
+	Codeplug *bundleFile `json:"codeplug,omitempty"`
+	Users    *bundleFile `json:"users,omitempty"`
+}
+
+type bundleFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// Bundle holds the images needed to provision a radio.
+type Bundle struct {
+	Model    string // the radio model the bundle is for
+	Firmware []byte // firmware image, as accepted by WriteFirmware, or nil
+	Codeplug []byte // raw codeplug image, or nil
+	Users    []byte // raw users image in the model's UsersFormat, or nil
+
+	manifest []byte // the original manifest, if read from a file
+}
+
+// ReadBundle reads and parses a bundle.
+func ReadBundle(rdr io.Reader) (*Bundle, error) {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, wrapError("ReadBundle", err)
+	}
+
+	return ParseBundle(data)
+}
+
+// ParseBundle parses a bundle, checking that the model is known and
+// that each file matches the hash given in the manifest.
+func ParseBundle(data []byte) (*Bundle, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, wrapError("ParseBundle", err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	manifest, err := readZipFile(files, bundleManifestName)
+	if err != nil {
+		return nil, wrapError("ParseBundle", err)
+	}
+
+	var m bundleManifest
+	err = json.Unmarshal(manifest, &m)
+	if err != nil {
+		return nil, wrapError("ParseBundle", err)
+	}
+
+	if LookupProfile(m.Model) == nil {
+		return nil, fmt.Errorf("ParseBundle: unknown radio model %q", m.Model)
+	}
+
+	b := &Bundle{
+		Model:    m.Model,
+		manifest: manifest,
+	}
+
+	entries := []struct {
+		file *bundleFile
+		data *[]byte
+	}{
+		{m.Firmware, &b.Firmware},
+		{m.Codeplug, &b.Codeplug},
+		{m.Users, &b.Users},
+	}
+	for _, e := range entries {
+		if e.file == nil {
+			continue
+		}
+
+		*e.data, err = readZipFile(files, e.file.Name)
+		if err != nil {
+			return nil, wrapError("ParseBundle", err)
+		}
+
+		sum := sha256.Sum256(*e.data)
+		if hex.EncodeToString(sum[:]) != e.file.SHA256 {
+			return nil, fmt.Errorf("ParseBundle: %s: SHA-256 does not match manifest", e.file.Name)
+		}
+	}
+
+	return b, nil
+}
+
+func readZipFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f := files[name]
+	if f == nil {
+		return nil, fmt.Errorf("%s: not found", name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, wrapError(name, err)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, wrapError(name, err)
+	}
+
+	return data, nil
+}
+
+// Manifest returns the bundle's manifest.  This is what a bundle
+// signature covers.  The manifest read by ReadBundle or ParseBundle is
+// returned unchanged unless the bundle has since been modified.
+func (b *Bundle) Manifest() []byte {
+	m := bundleManifest{
+		Model:    b.Model,
+		Firmware: newBundleFile("firmware.bin", b.Firmware),
+		Codeplug: newBundleFile("codeplug.bin", b.Codeplug),
+		Users:    newBundleFile("users.bin", b.Users),
+	}
+
+	if b.manifest != nil {
+		var old bundleManifest
+		err := json.Unmarshal(b.manifest, &old)
+		if err == nil && old.Model == m.Model &&
+			sameBundleFile(old.Firmware, m.Firmware) &&
+			sameBundleFile(old.Codeplug, m.Codeplug) &&
+			sameBundleFile(old.Users, m.Users) {
+			return b.manifest
+		}
+	}
+
+	data, err := json.MarshalIndent(&m, "", "\t")
+	if err != nil {
+		panic(err) // cannot happen, m contains only strings
+	}
+
+	return append(data, '\n')
+}
+
+func newBundleFile(name string, data []byte) *bundleFile {
+	if data == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+
+	return &bundleFile{
+		Name:   name,
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// sameBundleFile reports whether a and b describe the same contents.
+func sameBundleFile(a, b *bundleFile) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.SHA256 == b.SHA256
+}
+
+// Bytes returns b as a zip archive.
+func (b *Bundle) Bytes() []byte {
+	manifest := b.Manifest()
+
+	var m bundleManifest
+	err := json.Unmarshal(manifest, &m)
+	if err != nil {
+		panic(err) // cannot happen, the manifest was parsed or marshaled
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	writeFile := func(name string, data []byte) {
+		w, err := zw.Create(name)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			panic(err) // cannot happen, writes to a bytes.Buffer
+		}
+	}
+
+	writeFile(bundleManifestName, manifest)
+	if m.Firmware != nil {
+		writeFile(m.Firmware.Name, b.Firmware)
+	}
+	if m.Codeplug != nil {
+		writeFile(m.Codeplug.Name, b.Codeplug)
+	}
+	if m.Users != nil {
+		writeFile(m.Users.Name, b.Users)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// WriteTo writes b as a zip archive to w.
+func (b *Bundle) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+// ApplyBundle provisions a radio with the contents of b, in order: the
+// firmware, the codeplug and then the users database.  Each step
+// uses a new connection to the radio obtained by calling open, and
+// closes it when done, since the radio restarts after each step.  The
+// radio must be in bootloader mode when open is called for the
+// firmware step and in normal mode for the others, so open may need to
+// ask the operator to power-cycle the radio.
+//
+// Options are as for WriteFirmware and WriteCodeplug, except that the
+// RequireSignature and Report options apply to the bundle's manifest.
+// Unless the Force option is given, each step checks that the radio's
+// model matches the bundle, and a radio reporting a model that is not
+// in Profiles is refused unless its model is given with the Model
+// option.  ApplyBundle stops at the first error.
+func ApplyBundle(b *Bundle, open func() (*Dfu, error), opts ...Option) error {
+	o := newOptions(opts)
+	err := o.checkFile(b.Manifest())
+	if err != nil {
+		return err
+	}
+
+	profile := LookupProfile(b.Model)
+	if profile == nil {
+		return fmt.Errorf("ApplyBundle: unknown radio model %q", b.Model)
+	}
+
+	// A radio in bootloader mode cannot report its model, so the
+	// firmware is checked against the bundle's model instead.
+	fwOpts := *o
+	if fwOpts.model == "" {
+		fwOpts.model = b.Model
+	}
+
+	steps := []struct {
+		name  string
+		data  []byte
+		write func(dfu *Dfu) error
+	}{
+		{"firmware", b.Firmware, func(dfu *Dfu) error {
+			_, err := dfu.init()
+			if err != nil {
+				return err
+			}
+			return dfu.writeFirmwareFrom(bytes.NewReader(b.Firmware), &fwOpts)
+		}},
+		{"codeplug", b.Codeplug, func(dfu *Dfu) error {
+			return dfu.writeCodeplug(b.Codeplug, b.Model, o)
+		}},
+		{"users", b.Users, func(dfu *Dfu) error {
+			return dfu.writeBundleUsers(b.Users, profile, o)
+		}},
+	}
+
+	for _, step := range steps {
+		if step.data == nil {
+			continue
+		}
+
+		err := applyBundleStep(open, step.write)
+		if err != nil {
+			switch err.(type) {
+			case *MismatchError, *UnknownModelError, *PolicyError, *SignatureError, *ActionRequiredError:
+				return err
+			}
+			return wrapError("ApplyBundle: "+step.name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyBundleStep(open func() (*Dfu, error), write func(dfu *Dfu) error) error {
+	dfu, err := open()
+	if err != nil {
+		return err
+	}
+	defer dfu.Close()
+
+	return write(dfu)
+}
+
+// writeBundleUsers writes the raw users image data, in the format of
+// profile, after checking that the radio is of that model.
+func (dfu *Dfu) writeBundleUsers(data []byte, profile *Profile, o *options) error {
+	if !o.force {
+		radio, err := dfu.radioProfile("WriteUsers", o)
+		if err != nil {
+			return err
+		}
+		if radio != profile {
+			return &MismatchError{
+				Op:     "WriteUsers",
+				Model:  radio.Name,
+				Reason: fmt.Sprintf("users database is for model %q", profile.Name),
+			}
+		}
+	}
+
+	rdr := bytes.NewReader(data)
+	switch profile.UsersFormat {
+	case MD380Users:
+		return dfu.WriteRawMD380Users(rdr, len(data))
+	case UV380Users:
+		return dfu.WriteRawUV380Users(rdr, len(data))
+	}
+
+	return errors.New("writeBundleUsers: unknown users format")
+}
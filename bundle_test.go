@@ -0,0 +1,248 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// The address of the MD380 users database in SPI flash.
+const usersAddress = 0x100000
+
+// zipFiles returns a zip archive holding files, in the order given as
+// name, contents pairs.
+func zipFiles(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(files[i+1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func sha(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseBundle(t *testing.T) {
+	codeplug := "codeplug"
+	users := "users"
+	manifest := fmt.Sprintf(`{
+		"model": "MD380",
+		"codeplug": {"name": "cp.bin", "sha256": %q},
+		"users": {"name": "users.bin", "sha256": %q}
+	}`, sha(codeplug), sha(users))
+
+	b, err := dfu.ParseBundle(zipFiles(t,
+		"manifest.json", manifest,
+		"cp.bin", codeplug,
+		"users.bin", users))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Model != "MD380" || string(b.Codeplug) != codeplug || string(b.Users) != users || b.Firmware != nil {
+		t.Errorf("parsed %+v", b)
+	}
+	if !bytes.Equal(b.Manifest(), []byte(manifest)) {
+		t.Error("manifest is not the one read")
+	}
+
+	again, err := dfu.ParseBundle(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Manifest(), b.Manifest()) || !bytes.Equal(again.Codeplug, b.Codeplug) {
+		t.Error("bundle changed when written and read again")
+	}
+}
+
+func TestParseBundleErrors(t *testing.T) {
+	codeplug := "codeplug"
+	manifest := func(model, sum string) string {
+		return fmt.Sprintf(`{"model": %q, "codeplug": {"name": "cp.bin", "sha256": %q}}`, model, sum)
+	}
+
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{"hash mismatch", []string{
+			"manifest.json", manifest("MD380", sha("other")),
+			"cp.bin", codeplug,
+		}},
+		{"unknown model", []string{
+			"manifest.json", manifest("MD999", sha(codeplug)),
+			"cp.bin", codeplug,
+		}},
+		{"missing file", []string{
+			"manifest.json", manifest("MD380", sha(codeplug)),
+		}},
+		{"missing manifest", []string{
+			"cp.bin", codeplug,
+		}},
+		{"bad manifest", []string{
+			"manifest.json", "{",
+			"cp.bin", codeplug,
+		}},
+	}
+
+	for _, test := range tests {
+		_, err := dfu.ParseBundle(zipFiles(t, test.files...))
+		if err == nil {
+			t.Errorf("%s: bundle accepted", test.name)
+		}
+	}
+
+	_, err := dfu.ParseBundle([]byte("not a zip archive"))
+	if err == nil {
+		t.Error("not a zip archive: bundle accepted")
+	}
+}
+
+// radioContents records what has been written to a radio.
+type radioContents struct {
+	firmware, codeplug, users bool
+}
+
+func contents(radio *sim.Radio, b *dfu.Bundle) radioContents {
+	return radioContents{
+		firmware: radio.InternalFlash(appBase, 1)[0] != 0xff,
+		codeplug: bytes.Equal(radio.Flash(0, len(b.Codeplug)), b.Codeplug),
+		users:    bytes.Equal(radio.SPIFlash(usersAddress, len(b.Users)), b.Users),
+	}
+}
+
+func TestApplyBundle(t *testing.T) {
+	b, err := dfu.ParseBundle((&dfu.Bundle{
+		Model:    "MD380",
+		Firmware: testFirmware(t),
+		Codeplug: testCodeplug(1),
+		Users:    []byte("3\n1,A,B,C,D,E,F\n"),
+	}).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The radio is in bootloader mode for the firmware, then restarts
+	// normally.  Each step sees what the earlier steps wrote.
+	radio := sim.New("MD380")
+	var seen []radioContents
+	open := func() (*dfu.Dfu, error) {
+		radio.SetBootloader(len(seen) == 0)
+		seen = append(seen, contents(radio, b))
+		return dfu.NewWithTransport(radio, nil)
+	}
+
+	var result dfu.Result
+	err = dfu.ApplyBundle(b, open, dfu.Report(&result))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []radioContents{
+		{false, false, false},
+		{true, false, false},
+		{true, true, false},
+	}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("steps saw %v, want %v", seen, want)
+	}
+	if got := contents(radio, b); got != (radioContents{true, true, true}) {
+		t.Errorf("radio holds %+v", got)
+	}
+	if sum := sha256.Sum256(b.Manifest()); result.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Error("the report does not hold the manifest's SHA-256")
+	}
+}
+
+func TestApplyBundleWrongModel(t *testing.T) {
+	otherFirmware := testFirmware(t)
+	copy(otherFirmware[firmware.RadioOffset:], []byte{0x30, 0x03})
+
+	tests := []struct {
+		name   string
+		bundle *dfu.Bundle
+		radio  string
+		opts   []dfu.Option
+		ok     bool
+		check  func(err error) bool
+	}{
+		{"firmware for other model", &dfu.Bundle{Model: "MD380", Firmware: otherFirmware}, "MD380", nil, false,
+			func(err error) bool { _, ok := err.(*dfu.MismatchError); return ok }},
+		{"codeplug for other model", &dfu.Bundle{Model: "UV380", Codeplug: make([]byte, dfu.LookupProfile("UV380").CodeplugSize)}, "MD380", nil, false,
+			func(err error) bool { _, ok := err.(*dfu.MismatchError); return ok }},
+		{"users for other model", &dfu.Bundle{Model: "UV380", Users: []byte("users")}, "MD380", nil, false,
+			func(err error) bool { _, ok := err.(*dfu.MismatchError); return ok }},
+		{"unknown radio", &dfu.Bundle{Model: "MD380", Codeplug: testCodeplug(1)}, "MD999", nil, false,
+			func(err error) bool { _, ok := err.(*dfu.UnknownModelError); return ok }},
+		{"unknown radio users", &dfu.Bundle{Model: "MD380", Users: []byte("users")}, "MD999", nil, false,
+			func(err error) bool { _, ok := err.(*dfu.UnknownModelError); return ok }},
+		{"unknown radio forced", &dfu.Bundle{Model: "MD380", Codeplug: testCodeplug(1)}, "MD999", []dfu.Option{dfu.Force()}, true, nil},
+		{"unknown radio declared", &dfu.Bundle{Model: "MD380", Codeplug: testCodeplug(1)}, "MD999", []dfu.Option{dfu.Model("MD380")}, true, nil},
+	}
+
+	for _, test := range tests {
+		radio := sim.New(test.radio)
+		radio.SetBootloader(test.bundle.Firmware != nil)
+		open := func() (*dfu.Dfu, error) {
+			return dfu.NewWithTransport(radio, nil)
+		}
+
+		err := dfu.ApplyBundle(test.bundle, open, test.opts...)
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			continue
+		}
+		if !test.check(err) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if radio.InternalFlash(appBase, 1)[0] != 0xff || radio.Flash(0, 1)[0] != 0xff || radio.SPIFlash(usersAddress, 1)[0] != 0xff {
+			t.Errorf("%s: the radio was written", test.name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stderrLogger writes the dfu package's log records to stderr, one per
+// line, as the level, message and key=value pairs.  Multi-line values,
+// such as hexdumps, follow on their own lines, each after a line
+// holding its key and "=".
+type stderrLogger struct {
+	mu sync.Mutex
+}
+
+func (l *stderrLogger) Trace(msg string, args ...interface{}) { l.log("TRACE", msg, args) }
+func (l *stderrLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *stderrLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *stderrLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *stderrLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+func (l *stderrLogger) log(level, msg string, args []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", time.Now().Format("15:04:05.000"), level, msg)
+
+	var blocks []string
+	for i := 0; i+1 < len(args); i += 2 {
+		value := fmt.Sprint(args[i+1])
+		if strings.Contains(value, "\n") {
+			if !strings.HasSuffix(value, "\n") {
+				value += "\n"
+			}
+			blocks = append(blocks, fmt.Sprintf("%v=\n%s", args[i], value))
+			continue
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], value)
+	}
+	b.WriteString("\n")
+	for _, block := range blocks {
+		b.WriteString(block)
+	}
+
+	l.mu.Lock()
+	os.Stderr.WriteString(b.String())
+	l.mu.Unlock()
+}
@@ -0,0 +1,959 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// Dfu reads and writes the codeplug, users database, SPI flash and
+// firmware of TYT MD-380 family radios over USB.
+//
+// Usage:
+//
+//	dfu [-json] [-quiet] [-v [-trace]] [-device selector] [-reconnect timeout] command [arguments]
+//
+// Run "dfu -help" for the list of commands.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+)
+
+// Exit codes.  Each of the package's typed errors has its own code so
+// scripts can tell them apart.
+const (
+	exitOK            = 0
+	exitError         = 1 // any other error
+	exitUsage         = 2
+	exitMismatch      = 3 // *dfu.MismatchError
+	exitPolicy        = 4 // *dfu.PolicyError
+	exitSignature     = 5 // *dfu.SignatureError
+	exitReadProtected = 6 // *dfu.ReadProtectedError
+	exitUnknownModel  = 7 // *dfu.UnknownModelError
+	exitAction        = 8 // *dfu.ActionRequiredError
+)
+
+type command struct {
+	args  string
+	usage string
+	run   func(fs *flag.FlagSet, args []string) (interface{}, error)
+	flags func(fs *flag.FlagSet)
+}
+
+var commands = map[string]*command{
+	"list": &command{
+		usage: "list the attached radios",
+		run:   runList,
+	},
+	"info": &command{
+		usage: "print information about the attached radio",
+		run:   runInfo,
+	},
+	"read-codeplug": &command{
+		args:  "file",
+		usage: "read the codeplug to file (.rdt or raw)",
+		run:   runReadCodeplug,
+	},
+	"write-codeplug": &command{
+		args:  "file",
+		usage: "write the codeplug from file (.rdt or raw)",
+		run:   runWriteCodeplug,
+		flags: codeplugFlags,
+	},
+	"read-spi": &command{
+		args:  "file",
+		usage: "read the whole SPI flash to file",
+		run:   runReadSPI,
+	},
+	"write-spi": &command{
+		args:  "file",
+		usage: "write file to the start of the SPI flash (requires -force)",
+		run:   runWriteSPI,
+		flags: forceFlag,
+	},
+	"read-users": &command{
+		args:  "file",
+		usage: "read the users database to file (MD380 format radios only)",
+		run:   runReadUsers,
+	},
+	"write-users": &command{
+		args:  "file",
+		usage: "write the users database image in file, in the radio's format",
+		run:   runWriteUsers,
+		flags: forceFlag,
+	},
+	"write-firmware": &command{
+		args:  "file",
+		usage: "write firmware from file to a radio in bootloader mode",
+		run:   runWriteFirmware,
+		flags: firmwareFlags,
+	},
+	"set-time": &command{
+		usage: "set the radio's clock",
+		run:   runSetTime,
+		flags: timeFlag,
+	},
+}
+
+var (
+	jsonOutput = flag.Bool("json", false, "write results and errors as JSON to stdout")
+	quiet      = flag.Bool("quiet", false, "do not show a progress bar")
+	verbose    = flag.Bool("v", false, "log the commands sent to the radio on stderr")
+	trace      = flag.Bool("trace", false, "with -v, also log every USB request and a hexdump of the data transferred")
+	device     = flag.String("device", "", "the radio to use, by USB path, bus:address or serial, as shown by list")
+	reconnect  = flag.Duration("reconnect", 0, "after a write restarts the radio, wait up to `timeout` for it to return and check it is the same radio")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *verbose {
+		dfu.SetLogger(&stderrLogger{}, *trace)
+	}
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	name := flag.Arg(0)
+	cmd := commands[name]
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "dfu: unknown command %q\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dfu %s [flags] %s\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+	fs.Parse(flag.Args()[1:])
+
+	if fs.NArg() != len(strings.Fields(cmd.args)) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	result, err := cmd.run(fs, fs.Args())
+	progress.done()
+
+	code := exitCode(err)
+	if *jsonOutput {
+		output := map[string]interface{}{
+			"command": name,
+		}
+		if err != nil {
+			output["error"] = err.Error()
+			output["exitCode"] = code
+		} else {
+			output["result"] = result
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(output)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "dfu: %s\n", err.Error())
+		if e, ok := err.(*dfu.ActionRequiredError); ok {
+			fmt.Fprintln(os.Stderr, e.Action.Instructions())
+		}
+	} else if s, ok := result.(fmt.Stringer); ok {
+		fmt.Print(s.String())
+	}
+
+	os.Exit(code)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: dfu [-json] [-quiet] [-v [-trace]] [-device selector] [-reconnect timeout] command [arguments]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name+" "+cmd.args, cmd.usage)
+	}
+}
+
+func exitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return exitOK
+	case *dfu.MismatchError:
+		return exitMismatch
+	case *dfu.PolicyError:
+		return exitPolicy
+	case *dfu.SignatureError:
+		return exitSignature
+	case *dfu.ReadProtectedError:
+		return exitReadProtected
+	case *dfu.UnknownModelError:
+		return exitUnknownModel
+	case *dfu.ActionRequiredError:
+		return exitAction
+	}
+
+	return exitError
+}
+
+// progressBar draws a progress bar on stderr.  Operations report
+// progress in several phases, each running from dfu.MinProgress to
+// dfu.MaxProgress.
+type progressBar struct {
+	drawn   bool
+	percent int
+}
+
+var progress = &progressBar{percent: -1}
+
+const progressWidth = 50
+
+func (p *progressBar) update(counter int) error {
+	if *quiet || *jsonOutput || *verbose {
+		return nil
+	}
+
+	percent := counter * 100 / dfu.MaxProgress
+	if percent > 100 {
+		percent = 100
+	}
+	if percent == p.percent {
+		return nil
+	}
+	p.percent = percent
+	p.drawn = true
+
+	n := percent * progressWidth / 100
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %3d%%",
+		strings.Repeat("=", n), strings.Repeat(" ", progressWidth-n), percent)
+
+	return nil
+}
+
+func (p *progressBar) done() {
+	if p.drawn {
+		fmt.Fprintln(os.Stderr)
+		p.drawn = false
+	}
+}
+
+func openRadio() (*dfu.Dfu, error) {
+	p := prompter()
+	if p == nil {
+		return dfu.Open(*device, progress.update)
+	}
+
+	return dfu.OpenPrompting(context.Background(), *device, p, progress.update)
+}
+
+// prompter returns a dfu.Prompter that asks the operator at the
+// terminal, or nil if the output is for a script.
+func prompter() dfu.Prompter {
+	if *jsonOutput {
+		return nil
+	}
+
+	return terminalPrompter{bufio.NewReader(os.Stdin)}
+}
+
+// terminalPrompter writes instructions to stderr and waits for the
+// operator to press Enter.
+type terminalPrompter struct {
+	in *bufio.Reader
+}
+
+func (t terminalPrompter) Prompt(p *dfu.Prompt) error {
+	progress.done()
+
+	if p.Attempt > 1 {
+		fmt.Fprintln(os.Stderr, "The radio is not ready yet.")
+	} else {
+		fmt.Fprintf(os.Stderr, "dfu: %s\n", p.Reason)
+	}
+	fmt.Fprintf(os.Stderr, "%s\nPress Enter when done: ", p.Action.Instructions())
+
+	_, err := t.in.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%s: canceled", p.Action)
+	}
+
+	return nil
+}
+
+// verifyReconnect, if -reconnect is set, waits for radio to restart
+// and reports whether the same radio came back.
+func verifyReconnect(radio *dfu.Dfu) (bool, error) {
+	if *reconnect == 0 {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *reconnect)
+	defer cancel()
+
+	radio, err := radio.Reconnect(ctx)
+	if err != nil {
+		return false, err
+	}
+	radio.Close()
+
+	return true, nil
+}
+
+var (
+	force        bool
+	model        string
+	setTime      string
+	sigFile      string
+	keysFile     string
+	allowFile    string
+	versionsFile string
+	minVersion   string
+	allowUnknown bool
+	keyFile      string
+	generic      bool
+)
+
+func forceFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&force, "force", false, "skip the checks that the image suits the radio")
+}
+
+func signatureFlags(fs *flag.FlagSet) {
+	fs.StringVar(&sigFile, "sig", "", "the detached signature `file` of the image, required with -keys")
+	fs.StringVar(&keysFile, "keys", "", "refuse an image not signed by a key in the key ring `file`")
+}
+
+func codeplugFlags(fs *flag.FlagSet) {
+	forceFlag(fs)
+	signatureFlags(fs)
+	fs.StringVar(&model, "model", "", "the radio's `model`, if it reports one this program does not know")
+}
+
+func firmwareFlags(fs *flag.FlagSet) {
+	forceFlag(fs)
+	signatureFlags(fs)
+	fs.StringVar(&model, "model", "", "the radio's `model`, checked against the firmware header")
+	fs.StringVar(&allowFile, "allow", "", "refuse firmware whose SHA-256 is not listed in `file`")
+	fs.StringVar(&versionsFile, "versions", "", "the versions of known firmware, from `file` lines of SHA-256 and version")
+	fs.StringVar(&minVersion, "min-version", "", "refuse firmware older than `version`")
+	fs.BoolVar(&allowUnknown, "allow-unknown", false, "accept firmware not in the -allow file, or whose version is unknown, unless older than -min-version")
+	fs.StringVar(&keyFile, "key", "", "encrypt a plaintext image with the vendor key in `file`")
+	fs.BoolVar(&generic, "generic", false, "treat the device as a plain STM32 DfuSe bootloader, not a TYT radio")
+}
+
+func timeFlag(fs *flag.FlagSet) {
+	fs.StringVar(&setTime, "time", "", "the `time` to set, in RFC 3339 format (default now)")
+}
+
+func writeOptions() ([]dfu.Option, error) {
+	var opts []dfu.Option
+	if force {
+		opts = append(opts, dfu.Force())
+	}
+	if model != "" {
+		opts = append(opts, dfu.Model(model))
+	}
+
+	if keysFile != "" || sigFile != "" {
+		opt, err := signatureOption()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+
+	if allowFile != "" || versionsFile != "" || minVersion != "" {
+		policy, err := firmwarePolicy()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dfu.Policy(policy))
+	}
+
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c, err := firmware.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dfu.Cipher(c))
+	}
+
+	if generic {
+		opts = append(opts, dfu.Generic())
+	}
+
+	return opts, nil
+}
+
+// signatureOption returns the RequireSignature option for -sig and
+// -keys.  A missing -sig or -keys refuses every image.
+func signatureOption() (dfu.Option, error) {
+	var sig *dfu.Signature
+	if sigFile != "" {
+		text, err := ioutil.ReadFile(sigFile)
+		if err != nil {
+			return nil, err
+		}
+		sig, err = dfu.ParseSignature(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keys dfu.KeyRing
+	if keysFile != "" {
+		text, err := ioutil.ReadFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err = dfu.ParseKeyRing(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dfu.RequireSignature(sig, keys), nil
+}
+
+// firmwarePolicy returns the policy given by -allow, -versions,
+// -min-version and -allow-unknown.
+func firmwarePolicy() (*dfu.FirmwarePolicy, error) {
+	policy := &dfu.FirmwarePolicy{
+		Allowed:      make(map[string]bool),
+		Versions:     make(map[string]string),
+		MinVersion:   minVersion,
+		AllowUnknown: allowUnknown,
+	}
+
+	if allowFile != "" {
+		lines, err := readHashLines(allowFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("%s: no firmware hashes", allowFile)
+		}
+		for _, fields := range lines {
+			policy.Allowed[fields[0]] = true
+		}
+	}
+
+	if versionsFile != "" {
+		lines, err := readHashLines(versionsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, fields := range lines {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s: no version for %s", versionsFile, fields[0])
+			}
+			policy.Versions[fields[0]] = fields[1]
+		}
+	}
+
+	return policy, nil
+}
+
+// readHashLines returns the fields of the lines of filename, each
+// starting with a hex SHA-256 hash.  Blank lines and lines starting
+// with '#' are ignored.
+func readHashLines(filename string) ([][]string, error) {
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines [][]string
+	for _, line := range strings.Split(string(text), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fields[0] = strings.ToLower(fields[0])
+		if len(fields[0]) != 64 || strings.Trim(fields[0], "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("%s: bad SHA-256 %q", filename, fields[0])
+		}
+		lines = append(lines, fields)
+	}
+
+	return lines, nil
+}
+
+// fileResult reports a file read from or written to the radio.
+type fileResult struct {
+	File        string `json:"file"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+	Reconnected bool   `json:"reconnected,omitempty"`
+}
+
+func (r *fileResult) String() string {
+	s := fmt.Sprintf("%s: %d bytes\n", r.File, r.Size)
+	if r.SHA256 != "" {
+		s = fmt.Sprintf("%s: %d bytes, sha256 %s\n", r.File, r.Size, r.SHA256)
+	}
+	if r.Reconnected {
+		s += "Radio reconnected\n"
+	}
+	return s
+}
+
+type deviceResult struct {
+	Path         string `json:"path"`
+	Bus          int    `json:"bus"`
+	Address      int    `json:"address"`
+	VendorID     int    `json:"vendorID"`
+	ProductID    int    `json:"productID"`
+	Serial       string `json:"serial"`
+	Manufacturer string `json:"manufacturer"`
+	Mode         string `json:"mode"`
+}
+
+type listResult []*deviceResult
+
+func (r listResult) String() string {
+	var b strings.Builder
+	for _, d := range r {
+		fmt.Fprintf(&b, "%-8s %d:%d %04x:%04x %-12s %-11s %s\n",
+			d.Path, d.Bus, d.Address, d.VendorID, d.ProductID, d.Mode, d.Serial, d.Manufacturer)
+	}
+
+	return b.String()
+}
+
+func runList(fs *flag.FlagSet, args []string) (interface{}, error) {
+	devices, err := dfu.List()
+	if err != nil {
+		return nil, err
+	}
+
+	r := listResult{}
+	for _, d := range devices {
+		r = append(r, &deviceResult{
+			Path:         d.Path,
+			Bus:          d.Bus,
+			Address:      d.Address,
+			VendorID:     d.VendorID,
+			ProductID:    d.ProductID,
+			Serial:       d.Serial,
+			Manufacturer: d.Manufacturer,
+			Mode:         d.Mode(),
+		})
+	}
+
+	return r, nil
+}
+
+type infoResult struct {
+	Manufacturer string `json:"manufacturer"`
+	Bootloader   bool   `json:"bootloader"`
+	Model        string `json:"model,omitempty"`
+	Profile      string `json:"profile,omitempty"`
+	CodeplugSize int    `json:"codeplugSize,omitempty"`
+	SPIFlash     string `json:"spiFlash,omitempty"`
+	UniqueID     string `json:"uniqueID"`
+}
+
+func (r *infoResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Manufacturer: %s\n", r.Manufacturer)
+	fmt.Fprintf(&b, "Bootloader:   %t\n", r.Bootloader)
+	if r.Model != "" {
+		fmt.Fprintf(&b, "Model:        %s\n", r.Model)
+	}
+	if r.Profile != "" {
+		fmt.Fprintf(&b, "Profile:      %s (codeplug %d bytes)\n", r.Profile, r.CodeplugSize)
+	}
+	if r.SPIFlash != "" {
+		fmt.Fprintf(&b, "SPI flash:    %s\n", r.SPIFlash)
+	}
+	fmt.Fprintf(&b, "Unique ID:    %s\n", r.UniqueID)
+
+	return b.String()
+}
+
+func runInfo(fs *flag.FlagSet, args []string) (interface{}, error) {
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	info, err := radio.RadioInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &infoResult{
+		Manufacturer: info.Manufacturer,
+		Bootloader:   info.Bootloader,
+		Model:        info.Model,
+		SPIFlash:     info.SPIFlash,
+		UniqueID:     info.UniqueID,
+	}
+	if info.Profile != nil {
+		r.Profile = info.Profile.Name
+		r.CodeplugSize = info.Profile.CodeplugSize
+	}
+
+	return r, nil
+}
+
+func isRDT(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".rdt")
+}
+
+func runReadCodeplug(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int
+	if isRDT(filename) {
+		var profile *dfu.Profile
+		profile, err = radio.Profile()
+		if err == nil {
+			size = profile.CodeplugSize
+			err = radio.ReadCodeplugRDT(f, profile.Name, size)
+		}
+	} else {
+		size, err = radio.ReadCodeplugAuto(f)
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+
+	return &fileResult{File: filename, Size: size}, nil
+}
+
+func runWriteCodeplug(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	opts, err := writeOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var result dfu.Result
+	opts = append(opts, dfu.Report(&result))
+
+	if isRDT(filename) {
+		err = radio.WriteCodeplugRDT(bytes.NewReader(data), opts...)
+	} else {
+		err = radio.WriteCodeplug(data, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reconnected, err := verifyReconnect(radio)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileResult{File: filename, Size: len(data), SHA256: result.SHA256, Reconnected: reconnected}, nil
+}
+
+func runReadSPI(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = radio.ReadSPIFlash(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+
+	return statResult(filename)
+}
+
+func runWriteSPI(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	if !force {
+		return nil, fmt.Errorf("write-spi overwrites the SPI flash, including the user database and the boot images; use -force to write %s", filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	err = radio.WriteSPIFlash(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	reconnected, err := verifyReconnect(radio)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileResult{File: filename, Size: int(fi.Size()), Reconnected: reconnected}, nil
+}
+
+func statResult(filename string) (*fileResult, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileResult{File: filename, Size: int(fi.Size())}, nil
+}
+
+func runReadUsers(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	profile, err := radio.Profile()
+	if err != nil {
+		return nil, err
+	}
+	if profile.UsersFormat != dfu.MD380Users {
+		return nil, fmt.Errorf("read-users: not supported for %s radios", profile.Name)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = radio.ReadMD380Users(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+
+	return statResult(filename)
+}
+
+func runWriteUsers(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	opts, err := writeOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var result dfu.Result
+	opts = append(opts, dfu.Report(&result))
+
+	err = radio.WriteRawUsers(bytes.NewReader(data), len(data), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	reconnected, err := verifyReconnect(radio)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileResult{File: filename, Size: len(data), SHA256: result.SHA256, Reconnected: reconnected}, nil
+}
+
+func runWriteFirmware(fs *flag.FlagSet, args []string) (interface{}, error) {
+	filename := args[0]
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	opts, err := writeOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var result dfu.Result
+	opts = append(opts,
+		dfu.Report(&result),
+		dfu.FirmwareFunc(func(fw *dfu.Firmware) error {
+			if !*quiet && !*jsonOutput {
+				fmt.Fprintf(os.Stderr, "Writing %s\n", fw.String())
+			}
+			return nil
+		}),
+	)
+
+	if p := prompter(); p != nil {
+		opts = append(opts, dfu.Prompting(p))
+	}
+
+	err = radio.WriteFirmware(f, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := statResult(filename)
+	if err != nil {
+		return nil, err
+	}
+	r.SHA256 = result.SHA256
+
+	return r, nil
+}
+
+type timeResult struct {
+	Time        time.Time `json:"time"`
+	Reconnected bool      `json:"reconnected,omitempty"`
+}
+
+func (r *timeResult) String() string {
+	s := fmt.Sprintf("Set time to %s\n", r.Time.Format(time.RFC3339))
+	if r.Reconnected {
+		s += "Radio reconnected\n"
+	}
+	return s
+}
+
+func runSetTime(fs *flag.FlagSet, args []string) (interface{}, error) {
+	t := time.Now()
+	if setTime != "" {
+		var err error
+		t, err = time.Parse(time.RFC3339, setTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	radio, err := openRadio()
+	if err != nil {
+		return nil, err
+	}
+	defer radio.Close()
+
+	err = radio.SetTime(t)
+	if err != nil {
+		return nil, err
+	}
+
+	reconnected, err := verifyReconnect(radio)
+	if err != nil {
+		return nil, err
+	}
+
+	return &timeResult{Time: t, Reconnected: reconnected}, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// Dfud serves the HTTP API of the server package for the radio
+// attached to this machine, so that it may be programmed remotely.
+//
+// Usage:
+//
+//	dfud [-addr host:port] [-simulate model]
+//
+// The attached radio is named "radio" in the API.  With -simulate, a
+// simulated radio of the given model is served instead, named "sim",
+// for trying out clients without a radio.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/server"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8380", "the `address` to listen on")
+	simulate := flag.String("simulate", "", "serve a simulated radio of the given `model`")
+	flag.Parse()
+
+	devices := map[string]server.Opener{
+		"radio": dfu.New,
+	}
+	if *simulate != "" {
+		radio := sim.New(*simulate)
+		devices = map[string]server.Opener{
+			"sim": func(progressCallback func(int) error) (*dfu.Dfu, error) {
+				return dfu.NewWithTransport(radio, progressCallback)
+			},
+		}
+	}
+
+	s := server.New(devices)
+	defer s.Close()
+
+	log.Printf("dfud: listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
@@ -0,0 +1,164 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The USB IDs of the STM32 DFU interface, used by the radios in both
+// bootloader and application mode.
+const (
+	usbVendorID  = 0x0483
+	usbProductID = 0xdf11
+)
+
+// errListNotSupported is returned by List where it is not supported.
+var errListNotSupported = errors.New("List: not supported on this platform")
+
+// DeviceInfo describes an attached radio, as returned by List.
+type DeviceInfo struct {
+	Path         string // the USB bus and port chain, as "bus-port.port"
+	Bus          int
+	Address      int // the USB device address on the bus
+	VendorID     int
+	ProductID    int
+	Serial       string
+	Manufacturer string
+	Bootloader   bool // the radio is in bootloader mode
+}
+
+// Mode returns "bootloader" or "application".
+func (info *DeviceInfo) Mode() string {
+	if info.Bootloader {
+		return "bootloader"
+	}
+	return "application"
+}
+
+func (info *DeviceInfo) String() string {
+	return fmt.Sprintf("%s %04x:%04x serial %q, %s mode", info.Path, info.VendorID, info.ProductID, info.Serial, info.Mode())
+}
+
+// usbPath returns the path of the device reached through ports, the
+// hub port numbers from the root hub down, on bus, as in "1-4.2".
+func usbPath(bus int, ports []int) string {
+	path := make([]string, len(ports))
+	for i, port := range ports {
+		path[i] = strconv.Itoa(port)
+	}
+
+	return fmt.Sprintf("%d-%s", bus, strings.Join(path, "."))
+}
+
+// sysfsUSBDevices is where Linux lists USB devices, each in a
+// directory named by its path and holding its bus and device address
+// in the busnum and devnum files.
+var sysfsUSBDevices = "/sys/bus/usb/devices"
+
+// sysfsPath returns the path, as in "1-4.2", of the device at address
+// on bus, as listed in dir, or "" if it is not listed there.
+func sysfsPath(dir string, bus, address int) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		// Skip root hubs, as "usb1", and interfaces, as "1-4:1.0".
+		if !strings.Contains(name, "-") || strings.Contains(name, ":") {
+			continue
+		}
+
+		busnum, ok := readSysfsInt(filepath.Join(dir, name, "busnum"))
+		if !ok || busnum != bus {
+			continue
+		}
+		devnum, ok := readSysfsInt(filepath.Join(dir, name, "devnum"))
+		if ok && devnum == address {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func readSysfsInt(filename string) (int, bool) {
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(text)))
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// matches reports whether info is selected by selector, a USB path as
+// in "1-4" or "1-4.2", a bus and device address as in "1:7", or a
+// serial number.
+func (info *DeviceInfo) matches(selector string) bool {
+	switch selector {
+	case info.Path, info.Serial, fmt.Sprintf("%d:%d", info.Bus, info.Address):
+		return true
+	}
+
+	return false
+}
+
+// selectDevice returns the index in infos of the one radio chosen by
+// selector, as for Open.
+func selectDevice(infos []*DeviceInfo, selector string) (int, error) {
+	found := -1
+	matches := 0
+	for i, info := range infos {
+		if info.matches(selector) {
+			matches++
+			if found < 0 {
+				found = i
+			}
+		}
+	}
+
+	switch {
+	case matches > 1:
+		return -1, fmt.Errorf("%d radios match %q", matches, selector)
+	case matches == 0 && len(infos) == 0:
+		return -1, fmt.Errorf("no radio found to match %q", selector)
+	case matches == 0:
+		return -1, fmt.Errorf("no radio matches %q", selector)
+	}
+
+	return found, nil
+}
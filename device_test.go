@@ -0,0 +1,142 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUSBPath(t *testing.T) {
+	tests := []struct {
+		bus   int
+		ports []int
+		path  string
+	}{
+		{1, []int{4}, "1-4"},
+		{1, []int{4, 2}, "1-4.2"},
+		{3, []int{1, 1, 3}, "3-1.1.3"},
+	}
+
+	for _, test := range tests {
+		path := usbPath(test.bus, test.ports)
+		if path != test.path {
+			t.Errorf("usbPath(%d, %v) is %q, want %q", test.bus, test.ports, path, test.path)
+		}
+	}
+
+	// Radios on different ports of the same hub are told apart.
+	a := &DeviceInfo{Path: usbPath(1, []int{4, 2}), Bus: 1, Address: 7}
+	b := &DeviceInfo{Path: usbPath(1, []int{4, 3}), Bus: 1, Address: 8}
+	if !a.matches("1-4.2") || b.matches("1-4.2") {
+		t.Error("selector 1-4.2 does not pick out the radio on hub port 2")
+	}
+}
+
+func TestSysfsPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	devices := []struct {
+		name         string
+		bus, address string
+	}{
+		{"usb1", "1", "1"},
+		{"1-4", "1", "5"},
+		{"1-4.2", "1", "7"},
+		{"1-4.3", "1", "8"},
+		{"2-4.2", "2", "7"},
+	}
+	for _, device := range devices {
+		path := filepath.Join(dir, device.name)
+		err := os.Mkdir(path, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(path, "busnum"), []byte(device.bus+"\n"), 0644)
+		ioutil.WriteFile(filepath.Join(path, "devnum"), []byte(device.address+"\n"), 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "1-4.2:1.0"), 0755)
+
+	tests := []struct {
+		bus, address int
+		path         string
+	}{
+		{1, 7, "1-4.2"},
+		{1, 8, "1-4.3"},
+		{2, 7, "2-4.2"},
+		{1, 9, ""},
+	}
+	for _, test := range tests {
+		path := sysfsPath(dir, test.bus, test.address)
+		if path != test.path {
+			t.Errorf("sysfsPath(%d, %d) is %q, want %q", test.bus, test.address, path, test.path)
+		}
+	}
+
+	if path := sysfsPath(filepath.Join(dir, "missing"), 1, 7); path != "" {
+		t.Errorf("sysfsPath of a missing directory is %q", path)
+	}
+}
+
+func TestSelectDevice(t *testing.T) {
+	infos := []*DeviceInfo{
+		{Path: "1-4.2", Bus: 1, Address: 7, Serial: "A"},
+		{Path: "1-4.3", Bus: 1, Address: 8, Serial: "B"},
+		{Path: "2-1", Bus: 2, Address: 3, Serial: "B"},
+	}
+
+	tests := []struct {
+		name     string
+		infos    []*DeviceInfo
+		selector string
+		index    int
+		err      string
+	}{
+		{"path", infos, "1-4.3", 1, ""},
+		{"bus and address", infos, "2:3", 2, ""},
+		{"serial", infos, "A", 0, ""},
+		{"several matches", infos, "B", -1, `2 radios match "B"`},
+		{"unknown selector", infos, "1-5", -1, `no radio matches "1-5"`},
+		{"no radios", nil, "A", -1, `no radio found to match "A"`},
+	}
+
+	for _, test := range tests {
+		index, err := selectDevice(test.infos, test.selector)
+		if index != test.index {
+			t.Errorf("%s: got index %d, want %d", test.name, index, test.index)
+		}
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package dfu
+
+import (
+	"fmt"
+
+	"github.com/dalefarnsworth-dmr/stdfu"
+	"github.com/google/gousb"
+)
+
+// List returns the attached radios, in bootloader or application mode.
+func List() ([]*DeviceInfo, error) {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	devs, err := openUSBDevices(ctx)
+
+	var infos []*DeviceInfo
+	for _, dev := range devs {
+		infos = append(infos, usbDeviceInfo(dev))
+		dev.Close()
+	}
+
+	if err != nil && len(infos) == 0 {
+		return nil, wrapError("List", err)
+	}
+
+	return infos, nil
+}
+
+// Open opens the radio chosen by selector, which selects exactly one
+// radio by its USB path as in "1-4" or "1-4.2", its bus and device
+// address as in "1:7", or its serial number, as reported by List.  An
+// empty selector opens the first radio found, using New.
+func Open(selector string, progressCallback func(progressCounter int) error) (*Dfu, error) {
+	if selector == "" {
+		return New(progressCallback)
+	}
+
+	ctx := gousb.NewContext()
+
+	devs, err := openUSBDevices(ctx)
+
+	infos := make([]*DeviceInfo, len(devs))
+	for i, dev := range devs {
+		infos[i] = usbDeviceInfo(dev)
+	}
+
+	i, selectErr := selectDevice(infos, selector)
+	for j, dev := range devs {
+		if j != i {
+			dev.Close()
+		}
+	}
+	if selectErr != nil {
+		ctx.Close()
+		if err != nil && len(infos) == 0 {
+			return nil, wrapError("Open", err)
+		}
+		return nil, wrapError("Open", selectErr)
+	}
+
+	t, err := newUSBTransport(ctx, devs[i])
+	if err != nil {
+		devs[i].Close()
+		ctx.Close()
+		return nil, wrapError("Open", err)
+	}
+
+	// NewWithTransport closes t if it fails.
+	dfu, err := NewWithTransport(t, progressCallback)
+	if err != nil {
+		return nil, dfuModeError("Open", err)
+	}
+	dfu.device = infos[i]
+
+	return dfu, nil
+}
+
+func openUSBDevices(ctx *gousb.Context) ([]*gousb.Device, error) {
+	return ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return desc.Vendor == usbVendorID && desc.Product == usbProductID
+	})
+}
+
+func usbDeviceInfo(dev *gousb.Device) *DeviceInfo {
+	desc := dev.Desc
+
+	// gousb reports only the last port of the chain, so the whole
+	// chain is read from sysfs where there is one.
+	path := sysfsPath(sysfsUSBDevices, desc.Bus, desc.Address)
+	if path == "" {
+		path = usbPath(desc.Bus, []int{desc.Port})
+	}
+
+	info := &DeviceInfo{
+		Path:      path,
+		Bus:       desc.Bus,
+		Address:   desc.Address,
+		VendorID:  int(desc.Vendor),
+		ProductID: int(desc.Product),
+	}
+
+	info.Serial, _ = dev.SerialNumber()
+	info.Manufacturer, _ = dev.Manufacturer()
+	info.Bootloader = info.Manufacturer == bootloaderManufacturer
+
+	return info
+}
+
+// DFU class requests, from the USB DFU 1.1 specification.
+const (
+	dfuDetach    = 0
+	dfuDnload    = 1
+	dfuUpload    = 2
+	dfuGetStatus = 3
+	dfuClrStatus = 4
+	dfuGetState  = 5
+	dfuAbort     = 6
+
+	usbRequestOut = 0x21 // class request to an interface, host to device
+	usbRequestIn  = 0xa1 // class request to an interface, device to host
+
+	dfuDetachTimeout = 1000 // milliseconds
+)
+
+// usbDevice is the part of a *gousb.Device used by usbTransport.
+type usbDevice interface {
+	Control(rType, request uint8, val, idx uint16, data []byte) (int, error)
+	GetStringDescriptor(descIndex int) (string, error)
+	InterfaceDescription(cfgNum, intfNum, altNum int) (string, error)
+}
+
+// usbTransport is a Transport for a device opened with gousb, through
+// which Open reaches the radio chosen by a selector.  stdfu.New opens
+// the first device with the STM32 DFU IDs itself, and the stdfu
+// package offers no way to open a chosen one.
+type usbTransport struct {
+	dev    usbDevice
+	cfgNum int
+	iface  int
+	closed bool
+
+	// claim claims an interface alternate setting of the active
+	// configuration, returning the function releasing it.
+	claim   func(iface, altSetting int) (func(), error)
+	release func()
+
+	// closeDevice closes the device and its gousb context.
+	closeDevice func()
+}
+
+func newUSBTransport(ctx *gousb.Context, dev *gousb.Device) (*usbTransport, error) {
+	dev.SetAutoDetach(true)
+
+	cfgNum, err := dev.ActiveConfigNum()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := dev.Config(cfgNum)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &usbTransport{
+		dev:    dev,
+		cfgNum: cfgNum,
+		claim: func(iface, altSetting int) (func(), error) {
+			intf, err := cfg.Interface(iface, altSetting)
+			if err != nil {
+				return nil, err
+			}
+			return intf.Close, nil
+		},
+		closeDevice: func() {
+			cfg.Close()
+			dev.Close()
+			ctx.Close()
+		},
+	}
+
+	err = t.SelectCurrentConfiguration(0, 0, 0)
+	if err != nil {
+		cfg.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *usbTransport) Close() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+
+	if t.release != nil {
+		t.release()
+	}
+	t.closeDevice()
+}
+
+func (t *usbTransport) out(request int, value int, data []byte) error {
+	_, err := t.dev.Control(usbRequestOut, uint8(request), uint16(value), uint16(t.iface), data)
+	return err
+}
+
+func (t *usbTransport) in(request int, value int, data []byte) (int, error) {
+	return t.dev.Control(usbRequestIn, uint8(request), uint16(value), uint16(t.iface), data)
+}
+
+func (t *usbTransport) Detach() error {
+	return t.out(dfuDetach, dfuDetachTimeout, nil)
+}
+
+func (t *usbTransport) Dnload(block int, data []byte) error {
+	return t.out(dfuDnload, block, data)
+}
+
+func (t *usbTransport) Upload(block int, data []byte) error {
+	_, err := t.in(dfuUpload, block, data)
+	return err
+}
+
+func (t *usbTransport) GetStatus() (stdfu.DfuStatus, error) {
+	buf := make([]byte, 6)
+
+	n, err := t.in(dfuGetStatus, 0, buf)
+	if err != nil {
+		return stdfu.DfuStatus{}, err
+	}
+	if n != len(buf) {
+		return stdfu.DfuStatus{}, fmt.Errorf("GetStatus: short reply of %d bytes", n)
+	}
+
+	status := stdfu.DfuStatus{
+		Status:      int(buf[0]),
+		PollTimeout: int(buf[1]) | int(buf[2])<<8 | int(buf[3])<<16,
+		State:       stdfu.State(buf[4]),
+		Discarded:   int(buf[5]),
+	}
+
+	return status, nil
+}
+
+func (t *usbTransport) ClrStatus() error {
+	return t.out(dfuClrStatus, 0, nil)
+}
+
+func (t *usbTransport) GetState() (stdfu.State, error) {
+	buf := make([]byte, 1)
+
+	n, err := t.in(dfuGetState, 0, buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(buf) {
+		return 0, fmt.Errorf("GetState: no reply")
+	}
+
+	return stdfu.State(buf[0]), nil
+}
+
+func (t *usbTransport) Abort() error {
+	return t.out(dfuAbort, 0, nil)
+}
+
+func (t *usbTransport) GetStringDescriptor(index int) (string, error) {
+	return t.dev.GetStringDescriptor(index)
+}
+
+// InterfaceDescription returns the string describing an alternate
+// setting of the active configuration.
+func (t *usbTransport) InterfaceDescription(iface, altSetting int) (string, error) {
+	return t.dev.InterfaceDescription(t.cfgNum, iface, altSetting)
+}
+
+// SelectCurrentConfiguration selects an interface and alternate setting
+// of the active configuration, which config must be 0 or match.
+func (t *usbTransport) SelectCurrentConfiguration(config, iface, altSetting int) error {
+	if config != 0 && config != t.cfgNum {
+		return fmt.Errorf("SelectCurrentConfiguration: configuration %d is not the active configuration %d", config, t.cfgNum)
+	}
+
+	if t.release != nil {
+		t.release()
+		t.release = nil
+	}
+
+	release, err := t.claim(iface, altSetting)
+	if err != nil {
+		return err
+	}
+	t.release = release
+	t.iface = iface
+
+	return nil
+}
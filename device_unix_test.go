@@ -0,0 +1,215 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package dfu
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+	"github.com/google/gousb"
+)
+
+// fakeUSBDevice answers the control requests a usbTransport makes
+// from a simulated radio, as the radio's USB interface would.
+type fakeUSBDevice struct {
+	radio  *sim.Radio
+	cfgNum int    // the active configuration
+	status []byte // if not nil, the reply to DFU_GETSTATUS
+}
+
+func (d *fakeUSBDevice) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	switch rType {
+	case usbRequestOut:
+		switch request {
+		case dfuDetach:
+			return 0, d.radio.Detach()
+		case dfuDnload:
+			return len(data), d.radio.Dnload(int(val), data)
+		case dfuClrStatus:
+			return 0, d.radio.ClrStatus()
+		case dfuAbort:
+			return 0, d.radio.Abort()
+		}
+	case usbRequestIn:
+		switch request {
+		case dfuUpload:
+			return len(data), d.radio.Upload(int(val), data)
+		case dfuGetStatus:
+			if d.status != nil {
+				return copy(data, d.status), nil
+			}
+			status, err := d.radio.GetStatus()
+			if err != nil {
+				return 0, err
+			}
+			return copy(data, []byte{byte(status.Status), 0, 0, 0, byte(status.State), 0}), nil
+		case dfuGetState:
+			state, err := d.radio.GetState()
+			if err != nil {
+				return 0, err
+			}
+			return copy(data, []byte{byte(state)}), nil
+		}
+	}
+
+	// A device stalls requests it does not support.
+	return 0, gousb.ErrorPipe
+}
+
+func (d *fakeUSBDevice) GetStringDescriptor(index int) (string, error) {
+	return d.radio.GetStringDescriptor(index)
+}
+
+func (d *fakeUSBDevice) InterfaceDescription(cfgNum, intfNum, altNum int) (string, error) {
+	if cfgNum != d.cfgNum {
+		return "", fmt.Errorf("configuration id %d not found", cfgNum)
+	}
+	return d.radio.InterfaceDescription(intfNum, altNum)
+}
+
+// newFakeUSBTransport returns a usbTransport for radio, the interface
+// alternate settings claimed through it, as "iface.alt", and whether
+// the device has been closed.
+func newFakeUSBTransport(radio *sim.Radio) (*usbTransport, map[string]bool, *bool) {
+	claimed := make(map[string]bool)
+	closed := false
+
+	t := &usbTransport{
+		dev:    &fakeUSBDevice{radio: radio, cfgNum: 1},
+		cfgNum: 1,
+		claim: func(iface, altSetting int) (func(), error) {
+			key := fmt.Sprintf("%d.%d", iface, altSetting)
+			claimed[key] = true
+			return func() { delete(claimed, key) }, nil
+		},
+		closeDevice: func() { closed = true },
+	}
+
+	return t, claimed, &closed
+}
+
+func TestUSBTransport(t *testing.T) {
+	radio := sim.New("MD380")
+	ut, claimed, closed := newFakeUSBTransport(radio)
+
+	d, err := NewWithTransport(ut, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := d.Profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, profile.CodeplugSize)
+	err = d.ReadCodeplug(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, radio.Flash(0, len(data))) {
+		t.Error("codeplug read differs from the radio's")
+	}
+
+	if !claimed["0.0"] || len(claimed) != 1 {
+		t.Errorf("claimed %v, want interface 0.0", claimed)
+	}
+
+	d.Close()
+	if len(claimed) != 0 || !*closed {
+		t.Errorf("after Close, claimed %v and device closed %v", claimed, *closed)
+	}
+}
+
+func TestUSBTransportGetStatus(t *testing.T) {
+	radio := sim.New("MD380")
+	ut, _, _ := newFakeUSBTransport(radio)
+	dev := ut.dev.(*fakeUSBDevice)
+
+	dev.status = []byte{0x0a, 2, 0, 0, 10, 0}
+	status, err := ut.GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != 0x0a || status.PollTimeout != 2 || status.State != 10 {
+		t.Errorf("got status %+v, want status 0x0a, poll timeout 2, state 10", status)
+	}
+
+	dev.status = []byte{0, 0}
+	_, err = ut.GetStatus()
+	if err == nil {
+		t.Error("a short GetStatus reply was accepted")
+	}
+}
+
+func TestUSBTransportInterfaceDescription(t *testing.T) {
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	ut, _, _ := newFakeUSBTransport(radio)
+
+	d, err := NewWithTransport(ut, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	desc, err := d.internalFlashString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := radio.InterfaceDescription(0, 0)
+	if desc != want {
+		t.Errorf("got interface string %q, want %q", desc, want)
+	}
+
+	ut.cfgNum = 2
+	_, err = d.internalFlashString()
+	if err == nil {
+		t.Error("no error for a configuration the device lacks")
+	}
+}
+
+func TestUSBTransportSelectCurrentConfiguration(t *testing.T) {
+	ut, claimed, _ := newFakeUSBTransport(sim.New("MD380"))
+
+	err := ut.SelectCurrentConfiguration(0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ut.SelectCurrentConfiguration(1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed["0.2"] || len(claimed) != 1 {
+		t.Errorf("claimed %v, want only interface 0.2", claimed)
+	}
+
+	err = ut.SelectCurrentConfiguration(2, 0, 0)
+	if err == nil {
+		t.Error("an inactive configuration was selected")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"errors"
+)
+
+// List returns the attached radios.  It is not supported on Windows.
+func List() ([]*DeviceInfo, error) {
+	return nil, errListNotSupported
+}
+
+// Open opens the radio chosen by selector.  On Windows only the empty
+// selector, choosing the first radio found as New does, is supported.
+func Open(selector string, progressCallback func(progressCounter int) error) (*Dfu, error) {
+	if selector != "" {
+		return nil, errors.New("Open: device selection is not supported on Windows")
+	}
+
+	return New(progressCallback)
+}
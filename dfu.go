@@ -33,6 +33,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -55,30 +57,98 @@ const (
 const spiEraseSPIFlashBlockDelay = 500 // milliseconds
 
 type Dfu struct {
-	stDfu             *stdfu.StDfu
+	stDfu             Transport
 	blockSize         int
 	eraseBlockSize    int
 	progressCallback  func(progressCounter int) error
 	progressFunc      func() error
 	progressIncrement int
 	progressCounter   int
+	profile           *Profile
+	closed            bool
+	logger            Logger
+	trace             bool
+	op                string // the operation in progress, for logging
+	simulated         bool   // the transport needs no delays
+
+	// The radio's identity when opened, for Reconnect.
+	device     *DeviceInfo // nil unless opened by Open with a selector
+	serial     string
+	bootloader bool
+	uniqueID   string // set once UniqueID succeeds
 }
 
 func (dfu *Dfu) Close() {
+	if dfu.closed {
+		return
+	}
+	dfu.closed = true
 	dfu.stDfu.Close()
 	dfu.progressCallback = nil
 }
 
+func (dfu *Dfu) toBCD(i int) byte {
+	return byte(i/10<<4 | i%10)
+}
+
+// SetTime sets the radio's clock to t, in t's location, and reboots
+// the radio.
+func (dfu *Dfu) SetTime(t time.Time) error {
+	defer dfu.operation("SetTime")()
+
+	year, month, day := t.Date()
+	hours, minutes, seconds := t.Clock()
+
+	_, err := dfu.init()
+	if err != nil {
+		return wrapError("SetTime", err)
+	}
+
+	err = dfu.md380Cmd([]md380Cmd{
+		md380Cmd{0x91, 0x02}, // Set time
+	})
+	if err != nil {
+		return wrapError("SetTime", err)
+	}
+
+	// As in md380tools, the BCD time follows a 0xb5 command byte.
+	cmd := []byte{
+		0xb5,
+		dfu.toBCD(year / 100),
+		dfu.toBCD(year % 100),
+		dfu.toBCD(int(month)),
+		dfu.toBCD(day),
+		dfu.toBCD(hours),
+		dfu.toBCD(minutes),
+		dfu.toBCD(seconds),
+	}
+
+	stDfu := dfu.stDfu
+
+	err = stDfu.Dnload(controlBlock, cmd)
+	if err != nil {
+		return wrapError("SetTime", err)
+	}
+
+	_, err = stDfu.GetStatus() // this changes state
+	if err != nil {
+		return wrapError("SetTime", err)
+	}
+
+	err = dfu.md380Reboot()
+	if err != nil {
+		return wrapError("SetTime", err)
+	}
+
+	return nil
+}
+
 /* This commented-out code is untested.
 
 func (dfu *Dfu) toDecimal(b byte) int {
 	return int(b&0xf + (b>>4)*10)
 }
 
-func (dfu *Dfu) toBCD(i int) byte {
-	return byte(i/10<<4 | i%10)
-}
-
 func (dfu *Dfu) GetTime() (time.Time, error) {
 	var year, day, hours, minutes, seconds int
 	var month time.Month
@@ -108,42 +178,6 @@ func (dfu *Dfu) GetTime() (time.Time, error) {
 	return time.Date(year, month, day, hours, minutes, seconds, 0, location), nil
 }
 
-func (dfu *Dfu) SetTime(t time.Time) error {
-	year, month, day := t.Date()
-	hours, minutes, seconds := t.Clock()
-	t.Format("20060102150405")
-	bytes := make([]byte, 7)
-	bytes[0] = dfu.toBCD(year / 100)
-	bytes[1] = dfu.toBCD(year % 100)
-	bytes[2] = dfu.toBCD(int(month))
-	bytes[3] = dfu.toBCD(day)
-	bytes[4] = dfu.toBCD(hours)
-	bytes[5] = dfu.toBCD(minutes)
-	bytes[6] = dfu.toBCD(seconds)
-
-	err := dfu.md380Cmd(0x91, 0x02)
-	if err != nil {
-		return err
-	}
-
-	err = dfu.write(controlBlock, bytes)
-	if err != nil {
-		return err
-	}
-
-	err = dfu.waitUntilReady()
-	if err != nil {
-		return err
-	}
-
-	err = dfu.md380Reboot()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 */
 
 func (dfu *Dfu) md380Reboot() error {
@@ -194,6 +228,8 @@ func (dfu *Dfu) setAddress(address int) error {
 	d := byte((address >> 24))
 	addrCmd := []byte{0x21, a, b, c, d}
 
+	dfu.debug("set address", "address", fmt.Sprintf("0x%08x", address))
+
 	stDfu := dfu.stDfu
 
 	err := stDfu.Dnload(controlBlock, addrCmd)
@@ -285,6 +321,8 @@ func (dfu *Dfu) eraseBlock(address int) error {
 		byte((address >> 24)),
 	}
 
+	dfu.debug("erase", "address", fmt.Sprintf("0x%08x", address))
+
 	stDfu := dfu.stDfu
 
 	err := stDfu.Dnload(controlBlock, addrCmd)
@@ -321,6 +359,8 @@ func (dfu *Dfu) eraseSPIFlashBlock(address int) error {
 		byte((address >> 24)),
 	}
 
+	dfu.debug("erase SPI flash", "address", fmt.Sprintf("0x%06x", address))
+
 	stDfu := dfu.stDfu
 
 	err := stDfu.Dnload(spiBlock, addrCmd)
@@ -379,7 +419,9 @@ func (dfu *Dfu) sleepMilliseconds(millis int) error {
 		if err != nil {
 			return err
 		}
-		time.Sleep(time.Duration(4 * time.Millisecond))
+		if !dfu.simulated {
+			time.Sleep(time.Duration(4 * time.Millisecond))
+		}
 	}
 
 	return nil
@@ -393,6 +435,17 @@ func (dfu *Dfu) wait() error {
 	return nil
 }
 
+// enterDfuModeError is returned by enterDfuMode when a request fails.
+// It keeps the request's error, so that New and Open can tell a stalled
+// request, after which the radio must be power cycled.
+type enterDfuModeError struct {
+	err error
+}
+
+func (e *enterDfuModeError) Error() string {
+	return "enterDfuMode: " + e.err.Error()
+}
+
 func (dfu *Dfu) enterDfuMode() error {
 	stDfu := dfu.stDfu
 
@@ -413,14 +466,19 @@ func (dfu *Dfu) enterDfuMode() error {
 	for {
 		state, err := stDfu.GetState()
 		if err != nil {
-			return wrapError("enterDfuMode", err)
+			return &enterDfuModeError{err}
 		}
 		if state == stdfu.DfuIdle {
 			break
 		}
+		if state == stdfu.DfuError {
+			dfu.warn("enterDfuMode: radio reported an error", "state", stateName(state))
+		} else {
+			dfu.debug("enterDfuMode", "state", stateName(state))
+		}
 		err = actionMap[state]()
 		if err != nil {
-			return wrapError("enterDfuMode", err)
+			return &enterDfuModeError{err}
 		}
 	}
 
@@ -430,6 +488,8 @@ func (dfu *Dfu) enterDfuMode() error {
 func (dfu *Dfu) md380Custom(acmd md380Cmd) error {
 	cmd := []byte{byte(acmd.a), byte(acmd.b)}
 
+	dfu.debug("md380 command", "cmd", fmt.Sprintf("%02x %02x", cmd[0], cmd[1]))
+
 	stDfu := dfu.stDfu
 
 	err := stDfu.Dnload(controlBlock, cmd)
@@ -589,6 +649,8 @@ func (dfu *Dfu) writeSPIFlashFrom(address, size int, iRdr io.Reader) error {
 }
 
 func (dfu *Dfu) ReadMD380Users(writer io.Writer) error {
+	defer dfu.operation("ReadMD380Users")()
+
 	address := 0x100000
 
 	_, err := dfu.init()
@@ -636,6 +698,8 @@ func (dfu *Dfu) ReadMD380Users(writer io.Writer) error {
 }
 
 func (dfu *Dfu) ReadSPIFlash(writer io.Writer) error {
+	defer dfu.operation("ReadSPIFlash")()
+
 	dfu.setMaxProgressCount(100)
 
 	_, err := dfu.init()
@@ -666,6 +730,29 @@ func (dfu *Dfu) ReadSPIFlash(writer io.Writer) error {
 	return nil
 }
 
+// WriteSPIFlash writes size bytes read from reader to the start of
+// the radio's SPI flash, as read by ReadSPIFlash.
+func (dfu *Dfu) WriteSPIFlash(reader io.Reader, size int) error {
+	defer dfu.operation("WriteSPIFlash")()
+
+	_, err := dfu.init()
+	if err != nil {
+		return wrapError("WriteSPIFlash", err)
+	}
+
+	err = dfu.writeSPIFlashFrom(0, size, reader)
+	if err != nil {
+		return wrapError("WriteSPIFlash", err)
+	}
+
+	err = dfu.md380Reboot()
+	if err != nil {
+		return wrapError("WriteSPIFlash", err)
+	}
+
+	return nil
+}
+
 func (dfu *Dfu) readSPIFlash(address int, bytes []byte) error {
 	cmd := []byte{
 		byte(0x01), // SPIFLASHREAD
@@ -753,7 +840,8 @@ func (dfu *Dfu) getCommand() ([]byte, error) {
 	return cmd, nil
 }
 
-func (dfu *Dfu) internalSPIFlashID() (string, error) {
+// spiFlashJEDEC returns the raw ID bytes reported by the SPI flash.
+func (dfu *Dfu) spiFlashJEDEC() ([]byte, error) {
 	bytes := make([]byte, 4)
 
 	stDfu := dfu.stDfu
@@ -761,22 +849,31 @@ func (dfu *Dfu) internalSPIFlashID() (string, error) {
 	cmd := []byte{0x05} // SPIFLASHGETID
 	err := stDfu.Dnload(spiBlock, cmd)
 	if err != nil {
-		return "", wrapError("spiFlashID", err)
+		return nil, wrapError("spiFlashID", err)
 	}
 
 	_, err = stDfu.GetStatus() // this changes state
 	if err != nil {
-		return "", wrapError("spiFlashID", err)
+		return nil, wrapError("spiFlashID", err)
 	}
 
 	_, err = stDfu.GetStatus() // this actually gets the state
 	if err != nil {
-		return "", wrapError("spiFlashID", err)
+		return nil, wrapError("spiFlashID", err)
 	}
 
 	err = stDfu.Upload(spiBlock, bytes)
 	if err != nil {
-		return "", wrapError("spiFlashID", err)
+		return nil, wrapError("spiFlashID", err)
+	}
+
+	return bytes, nil
+}
+
+func (dfu *Dfu) internalSPIFlashID() (string, error) {
+	bytes, err := dfu.spiFlashJEDEC()
+	if err != nil {
+		return "", err
 	}
 
 	var str string
@@ -831,6 +928,9 @@ func (dfu *Dfu) spiFlashSize() (int, error) {
 
 func (dfu *Dfu) setMaxProgressCount(max int) {
 	dfu.progressFunc = func() error { return nil }
+	if max < 1 {
+		max = 1
+	}
 	if dfu.progressCallback != nil {
 		dfu.progressIncrement = MaxProgress / max
 		dfu.progressCounter = 0
@@ -915,17 +1015,30 @@ func (dfu *Dfu) readFlashTo(address, size int, iWriter io.Writer) error {
 		blockNumber++
 	}
 
+	err = writer.Flush()
+	if err != nil {
+		return wrapError("readFlashTo", err)
+	}
+
 	dfu.finalProgress()
 
 	return nil
 }
 
 func (dfu *Dfu) writeFlashFrom(address, size int, iRdr io.Reader) error {
+	_, err := dfu.writeFlash(address, size, iRdr)
+	return err
+}
+
+// writeFlash does the work of writeFlashFrom.  It also reports whether
+// the flash may have been modified, that is, whether erasing was started
+// before the error occurred.
+func (dfu *Dfu) writeFlash(address, size int, iRdr io.Reader) (bool, error) {
 	if address%dfu.blockSize != 0 {
-		return fmt.Errorf("writeFlashFrom: address is not a multiple of blockSize")
+		return false, fmt.Errorf("writeFlashFrom: address is not a multiple of blockSize")
 	}
 	if size%dfu.blockSize != 0 {
-		return fmt.Errorf("WriteFlashFrom: codeplug data size is not a multiple of blocksize %d", dfu.blockSize)
+		return false, fmt.Errorf("WriteFlashFrom: codeplug data size is not a multiple of blocksize %d", dfu.blockSize)
 	}
 
 	dfu.setMaxProgressCount(2750)
@@ -941,7 +1054,7 @@ func (dfu *Dfu) writeFlashFrom(address, size int, iRdr io.Reader) error {
 		md380Cmd{0xa2, 0x07},
 	})
 	if err != nil {
-		return wrapError("writeFlashFrom", err)
+		return false, wrapError("writeFlashFrom", err)
 	}
 
 	dfu.finalProgress()
@@ -953,21 +1066,22 @@ func (dfu *Dfu) writeFlashFrom(address, size int, iRdr io.Reader) error {
 	rdr := bufio.NewReader(iRdr)
 	buf := make([]byte, dfu.blockSize)
 
+	// From here on, the flash contents are no longer known to be intact.
 	err = dfu.eraseFlashBlocks(address, size)
 	if err != nil {
-		return wrapError("writeFlashFrom", err)
+		return true, wrapError("writeFlashFrom", err)
 	}
 
 	err = dfu.setAddress(0x00000000)
 	if err != nil {
-		return wrapError("writeFlashFrom", err)
+		return true, wrapError("writeFlashFrom", err)
 	}
 
 	stDfu := dfu.stDfu
 
 	_, err = stDfu.GetStatus()
 	if err != nil {
-		return wrapError("writeFlashFrom", err)
+		return true, wrapError("writeFlashFrom", err)
 	}
 
 	dfu.setMaxProgressCount(blockCount)
@@ -975,12 +1089,12 @@ func (dfu *Dfu) writeFlashFrom(address, size int, iRdr io.Reader) error {
 	for i := 0; i < blockCount; i++ {
 		err := dfu.progressFunc()
 		if err != nil {
-			return err
+			return true, err
 		}
 
 		n, err := rdr.Read(buf)
 		if err != nil {
-			return wrapError("writeFlashFrom", err)
+			return true, wrapError("writeFlashFrom", err)
 		}
 
 		paddingSize := len(buf) - n
@@ -996,13 +1110,13 @@ func (dfu *Dfu) writeFlashFrom(address, size int, iRdr io.Reader) error {
 
 		err = stDfu.Dnload(adjustedBlockNumber, buf)
 		if err != nil {
-			return wrapError("writeFlashFrom", err)
+			return true, wrapError("writeFlashFrom", err)
 		}
 
 		for {
 			dfuStatus, err := stDfu.GetStatus()
 			if err != nil {
-				return wrapError("writeFlashFrom", err)
+				return true, wrapError("writeFlashFrom", err)
 			}
 
 			if dfuStatus.State == stdfu.DfuWriteIdle {
@@ -1014,7 +1128,7 @@ func (dfu *Dfu) writeFlashFrom(address, size int, iRdr io.Reader) error {
 
 	dfu.finalProgress()
 
-	return nil
+	return true, nil
 }
 
 type block struct {
@@ -1066,99 +1180,229 @@ func (dfu *Dfu) init() (mfg string, err error) {
 	return mfg, nil
 }
 
-func (dfu *Dfu) writeFirmwareFrom(iRdr io.Reader) error {
-	blocks := []block{
-		block{0x0800c000, 0x04000, 0x11},
-		block{0x08010000, 0x10000, 0x41},
-		block{0x08020000, 0x20000, 0x81},
-		block{0x08040000, 0x20000, 0x81},
-		block{0x08060000, 0x20000, 0x81},
-		block{0x08080000, 0x20000, 0x81},
-		block{0x080a0000, 0x20000, 0x81},
-		block{0x080c0000, 0x20000, 0x81},
-		block{0x080e0000, 0x20000, 0x81},
+// defaultFirmwareBlocks are the STM32F405 internal flash sectors above
+// the bootloader, which hold the radio's firmware.  They are used when
+// the bootloader does not describe its flash layout.
+var defaultFirmwareBlocks = []block{
+	block{0x0800c000, 0x04000, 0x11},
+	block{0x08010000, 0x10000, 0x41},
+	block{0x08020000, 0x20000, 0x81},
+	block{0x08040000, 0x20000, 0x81},
+	block{0x08060000, 0x20000, 0x81},
+	block{0x08080000, 0x20000, 0x81},
+	block{0x080a0000, 0x20000, 0x81},
+	block{0x080c0000, 0x20000, 0x81},
+	block{0x080e0000, 0x20000, 0x81},
+}
+
+func (dfu *Dfu) writeFirmwareFrom(iRdr io.Reader, o *options) error {
+	var blocks []block
+	var err error
+	if o.generic {
+		blocks, err = dfu.internalFlashBlocks()
+	} else {
+		blocks, err = dfu.firmwareBlocks()
+	}
+	if err != nil {
+		return wrapError("writeFirmware", err)
+	}
+
+	// Validate the whole image before anything is erased.
+	data, err := ioutil.ReadAll(iRdr)
+	if err != nil {
+		return wrapError("writeFirmware", err)
 	}
 
-	stDfu := dfu.stDfu
+	err = o.checkFile(data)
+	if err != nil {
+		return err
+	}
 
-	mfg, err := dfu.init()
+	fw, err := ParseFirmware(data)
 	if err != nil {
 		return wrapError("writeFirmware", err)
 	}
-	if mfg != "AnyRoad Technology" {
-		msg := `
-The radio is not in bootloader mode. Enter bootloader mode by holding
-down the PTT button and the button above it while turning on the radio.
-The radio's LED will blink green and red.`
-		return errors.New(msg[1:])
+
+	model := o.model
+	if model == "" && dfu.profile != nil {
+		model = dfu.profile.Name
+	}
+	if o.force {
+		model = ""
 	}
 
-	err = dfu.md380Cmd([]md380Cmd{
-		md380Cmd{0x91, 0x01}, // Programming Mode
-		md380Cmd{0x91, 0x31},
-	})
+	err = validateFirmware(fw, blocks, model)
+	if err != nil {
+		if _, ok := err.(*MismatchError); ok {
+			return err
+		}
+		return wrapError("writeFirmware", err)
+	}
+
+	if o.policy != nil {
+		err = o.policy.Check(fw)
+		if err != nil {
+			return err
+		}
+	}
 
-	dfu.setMaxProgressCount(len(blocks))
+	// The bootloader decrypts what it is sent, so plaintext must be
+	// encrypted.  A TYT image can only be checked once decrypted.
+	segments := fw.segments()
+	if o.cipher != nil {
+		switch fw.Kind {
+		case FirmwareTYT:
+			plain := []Segment{{fw.Address, o.cipher.Decrypt(fw.Payload)}}
+			err = checkVectorTable(plain, fw.Address)
+			if err != nil {
+				return wrapError("writeFirmware", err)
+			}
+		case FirmwareDfuSe:
+			return errors.New("writeFirmware: the Cipher option does not apply to DfuSe images")
+		default:
+			segments = []Segment{{fw.Address, o.cipher.Encrypt(fw.Payload)}}
+		}
+	}
 
-	totalBlocks := 0
-	for _, block := range blocks {
-		err := dfu.progressFunc()
+	if o.firmwareFunc != nil {
+		err = o.firmwareFunc(fw)
 		if err != nil {
 			return wrapError("writeFirmware", err)
 		}
-		dfu.eraseBlock(block.address)
-
-		totalBlocks += block.size / dfu.blockSize
 	}
 
-	dfu.finalProgress()
+	if o.generic {
+		err = dfu.programSegments(alignSegments(segments, dfu.blockSize), blocks)
+		if err != nil {
+			return wrapError("writeFirmware", err)
+		}
+		return nil
+	}
 
-	rdr := bufio.NewReader(iRdr)
-	header := "OutSecurityBin"
-	headerBytes, err := rdr.Peek(len(header))
+	mfg, err := dfu.init()
 	if err != nil {
 		return wrapError("writeFirmware", err)
 	}
-	if string(headerBytes) == header {
-		_, err = rdr.Discard(0x100)
+	if mfg != bootloaderManufacturer {
+		if o.prompter == nil {
+			return &ActionRequiredError{
+				Op:     "writeFirmware",
+				Action: EnterBootloader,
+				Reason: "the radio is not in bootloader mode",
+			}
+		}
+
+		err = dfu.awaitBootloader(o.prompter)
 		if err != nil {
 			return wrapError("writeFirmware", err)
 		}
 	}
 
-	buf := make([]byte, dfu.blockSize)
+	// Read the ID while the bootloader is still up, so Reconnect can
+	// confirm the radio that returns after it restarts.
+	_, err = dfu.UniqueID()
+	if err != nil {
+		dfu.warn("the radio cannot be confirmed after it restarts", "err", err.Error())
+	}
 
-	dfu.setMaxProgressCount(totalBlocks)
+	err = dfu.md380Cmd([]md380Cmd{
+		md380Cmd{0x91, 0x01}, // Programming Mode
+		md380Cmd{0x91, 0x31},
+	})
+	if err != nil {
+		return wrapError("writeFirmware", err)
+	}
 
+	err = dfu.programSegments(alignSegments(segments, dfu.blockSize), blocks)
+	if err != nil {
+		return wrapError("writeFirmware", err)
+	}
+
+	return nil
+}
+
+// programSegments erases the flash sectors in blocks that overlap
+// segments and writes the segments.  Each segment must start on a
+// blockSize boundary, as arranged by alignSegments.  Writing is done a
+// sector at a time, each starting from its own address.
+func (dfu *Dfu) programSegments(segments []Segment, blocks []block) error {
+	stDfu := dfu.stDfu
+
+	var eraseBlocks []block
 	for _, block := range blocks {
-		err = dfu.setAddress(block.address)
+		for _, seg := range segments {
+			if seg.Address < block.address+block.size && seg.Address+len(seg.Data) > block.address {
+				eraseBlocks = append(eraseBlocks, block)
+				break
+			}
+		}
+	}
+
+	totalBlocks := 0
+	for _, seg := range segments {
+		totalBlocks += (len(seg.Data) + dfu.blockSize - 1) / dfu.blockSize
+	}
+
+	dfu.setMaxProgressCount(len(eraseBlocks))
+
+	for _, block := range eraseBlocks {
+		err := dfu.progressFunc()
 		if err != nil {
-			return wrapError("writeFirmware", err)
+			return err
 		}
 
-		blockCount := block.size / dfu.blockSize
-		for blockNumber := 0; blockNumber < blockCount; blockNumber++ {
-			err := dfu.progressFunc()
-			if err != nil {
-				return wrapError("writeFirmware", err)
-			}
+		err = dfu.eraseBlock(block.address)
+		if err != nil {
+			return wrapError("programSegments", err)
+		}
+	}
 
-			err = fillBuffer(rdr, buf)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return wrapError("writeFirmware", err)
+	dfu.finalProgress()
+
+	dfu.setMaxProgressCount(totalBlocks)
+
+	for _, block := range eraseBlocks {
+		for _, seg := range segments {
+			start := seg.Address
+			if start < block.address {
+				start = block.address
+			}
+			end := seg.Address + len(seg.Data)
+			if end > block.address+block.size {
+				end = block.address + block.size
+			}
+			if start >= end {
+				continue
 			}
 
-			err = stDfu.Dnload(flashBlock+blockNumber, buf)
+			err := dfu.setAddress(start)
 			if err != nil {
-				return wrapError("writeFirmware", err)
+				return wrapError("programSegments", err)
 			}
 
-			err = dfu.waitUntilReady()
-			if err != nil {
-				return wrapError("writeFirmware", err)
+			data := seg.Data[start-seg.Address : end-seg.Address]
+			for blockNumber := 0; len(data) > 0; blockNumber++ {
+				err := dfu.progressFunc()
+				if err != nil {
+					return err
+				}
+
+				n := dfu.blockSize
+				if n > len(data) {
+					n = len(data)
+				}
+
+				err = stDfu.Dnload(flashBlock+blockNumber, data[:n])
+				if err != nil {
+					return wrapError("programSegments", err)
+				}
+
+				err = dfu.waitUntilReady()
+				if err != nil {
+					return wrapError("programSegments", err)
+				}
+
+				data = data[n:]
 			}
 		}
 	}
@@ -1168,24 +1412,40 @@ The radio's LED will blink green and red.`
 	return nil
 }
 
-func fillBuffer(rdr io.Reader, buf []byte) error {
-	for i := 0; i < len(buf); {
-		n, err := rdr.Read(buf[i:])
-		i += n
-		if n == 0 {
-			return err
+// alignSegments returns segments rearranged into runs of whole,
+// aligned blocks of blockSize bytes.  Bytes not covered by segments
+// are filled with 0xff, the value of erased flash.
+func alignSegments(segments []Segment, blockSize int) []Segment {
+	sorted := append([]Segment(nil), segments...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	var aligned []Segment
+	for _, seg := range sorted {
+		if len(seg.Data) == 0 {
+			continue
 		}
-		if err != nil {
-			if err == io.EOF {
-				err = nil
-				for j := range buf[i:] {
-					buf[i+j] = 0xff
-				}
-			}
-			return err
+
+		start := seg.Address - seg.Address%blockSize
+		end := seg.Address + len(seg.Data)
+		end += (blockSize - end%blockSize) % blockSize
+
+		last := len(aligned) - 1
+		if last < 0 || aligned[last].Address+len(aligned[last].Data) < start {
+			aligned = append(aligned, Segment{start, nil})
+			last++
 		}
+
+		run := &aligned[last]
+		grow := end - (run.Address + len(run.Data))
+		if grow > 0 {
+			run.Data = append(run.Data, bytes.Repeat([]byte{0xff}, grow)...)
+		}
+		copy(run.Data[seg.Address-run.Address:], seg.Data)
 	}
-	return nil
+
+	return aligned
 }
 
 func (dfu *Dfu) finalProgress() {
@@ -1196,6 +1456,8 @@ func (dfu *Dfu) finalProgress() {
 }
 
 func (dfu *Dfu) ReadCodeplug(data []byte) error {
+	defer dfu.operation("ReadCodeplug")()
+
 	size := len(data)
 	buffer := bytes.NewBuffer(data[:0])
 
@@ -1212,10 +1474,63 @@ func (dfu *Dfu) ReadCodeplug(data []byte) error {
 	return nil
 }
 
-func (dfu *Dfu) WriteCodeplug(data []byte) error {
+// ReadCodeplugAuto reads the radio's codeplug to w, using the radio's
+// model to determine its size.  It returns the number of bytes read.
+func (dfu *Dfu) ReadCodeplugAuto(w io.Writer) (int, error) {
+	defer dfu.operation("ReadCodeplugAuto")()
+
+	profile, err := dfu.Profile()
+	if err != nil {
+		if e, ok := err.(*UnknownModelError); ok {
+			e.Op = "ReadCodeplugAuto"
+			return 0, e
+		}
+		return 0, wrapError("ReadCodeplugAuto", err)
+	}
+	size := profile.CodeplugSize
+
+	err = dfu.readFlashTo(0, size, w)
+	if err != nil {
+		return 0, wrapError("ReadCodeplugAuto", err)
+	}
+
+	err = dfu.md380Reboot()
+	if err != nil {
+		return size, wrapError("ReadCodeplugAuto", err)
+	}
+
+	return size, nil
+}
+
+// WriteCodeplug writes data as the radio's codeplug.  Unless the Force
+// option is given, a codeplug whose size does not match the radio's
+// model is refused with a *MismatchError, and any codeplug for a radio
+// of unknown model with an *UnknownModelError, before anything is
+// erased.
+// The RequireSignature option refuses unsigned codeplugs, and the
+// Report option returns the codeplug's hash and signer.
+func (dfu *Dfu) WriteCodeplug(data []byte, opts ...Option) error {
+	defer dfu.operation("WriteCodeplug")()
+
+	return dfu.writeCodeplug(data, "", newOptions(opts))
+}
+
+func (dfu *Dfu) writeCodeplug(data []byte, model string, o *options) error {
+	err := o.checkFile(data)
+	if err != nil {
+		return err
+	}
+
+	if !o.force {
+		err := dfu.checkCodeplug("WriteCodeplug", data, model, o)
+		if err != nil {
+			return err
+		}
+	}
+
 	buffer := bytes.NewBuffer(data)
 
-	err := dfu.writeFlashFrom(0, len(data), buffer)
+	err = dfu.writeFlashFrom(0, len(data), buffer)
 	if err != nil {
 		return wrapError("WriteCodeplug", err)
 	}
@@ -1228,7 +1543,152 @@ func (dfu *Dfu) WriteCodeplug(data []byte) error {
 	return nil
 }
 
+// CodeplugState describes the radio's codeplug after WriteCodeplugAtomic.
+type CodeplugState int
+
+const (
+	CodeplugUnchanged CodeplugState = iota // not modified, the original is intact
+	CodeplugWritten                        // the new codeplug was written and verified
+	CodeplugRestored                       // the original codeplug was restored and verified
+	CodeplugCorrupt                        // the restore failed, contents are unknown
+)
+
+func (state CodeplugState) String() string {
+	switch state {
+	case CodeplugUnchanged:
+		return "unchanged"
+	case CodeplugWritten:
+		return "written"
+	case CodeplugRestored:
+		return "restored"
+	case CodeplugCorrupt:
+		return "corrupt"
+	}
+
+	return fmt.Sprintf("CodeplugState(%d)", int(state))
+}
+
+// WriteCodeplugAtomic writes data as the radio's codeplug and verifies
+// it.  The current codeplug is saved first and, if anything fails after
+// erasing has begun, including cancellation via the progress callback,
+// the saved codeplug is written back.  Options are as for
+// WriteCodeplug.  The returned state tells what
+// the radio was left containing, even when an error is returned.
+func (dfu *Dfu) WriteCodeplugAtomic(data []byte, opts ...Option) (CodeplugState, error) {
+	defer dfu.operation("WriteCodeplugAtomic")()
+
+	o := newOptions(opts)
+	err := o.checkFile(data)
+	if err != nil {
+		return CodeplugUnchanged, err
+	}
+
+	if !o.force {
+		err := dfu.checkCodeplug("WriteCodeplugAtomic", data, "", o)
+		if err != nil {
+			return CodeplugUnchanged, err
+		}
+	}
+
+	size := len(data)
+	saved := make([]byte, size)
+
+	err = dfu.readFlashTo(0, size, bytes.NewBuffer(saved[:0]))
+	if err != nil {
+		return CodeplugUnchanged, wrapError("WriteCodeplugAtomic", err)
+	}
+
+	err = dfu.enterDfuMode()
+	if err != nil {
+		return CodeplugUnchanged, wrapError("WriteCodeplugAtomic", err)
+	}
+
+	modified, err := dfu.writeFlash(0, size, bytes.NewReader(data))
+	if err == nil {
+		err = dfu.verifyFlash(0, data)
+	}
+	if err != nil {
+		if !modified {
+			return CodeplugUnchanged, wrapError("WriteCodeplugAtomic", err)
+		}
+
+		state := CodeplugRestored
+		restoreErr := dfu.restoreFlash(0, saved)
+		if restoreErr != nil {
+			state = CodeplugCorrupt
+			err = fmt.Errorf("%s; restore failed: %s", err.Error(), restoreErr.Error())
+		} else {
+			restoreErr = dfu.md380Reboot()
+			if restoreErr != nil {
+				err = fmt.Errorf("%s; %s", err.Error(), restoreErr.Error())
+			}
+		}
+
+		return state, wrapError("WriteCodeplugAtomic", err)
+	}
+
+	err = dfu.md380Reboot()
+	if err != nil {
+		return CodeplugWritten, wrapError("WriteCodeplugAtomic", err)
+	}
+
+	return CodeplugWritten, nil
+}
+
+// verifyFlash reads back len(data) bytes of flash at address and
+// compares them to data.
+func (dfu *Dfu) verifyFlash(address int, data []byte) error {
+	err := dfu.enterDfuMode()
+	if err != nil {
+		return wrapError("verifyFlash", err)
+	}
+
+	readBack := make([]byte, len(data))
+	err = dfu.readFlashTo(address, len(data), bytes.NewBuffer(readBack[:0]))
+	if err != nil {
+		return wrapError("verifyFlash", err)
+	}
+
+	for i := range data {
+		if readBack[i] != data[i] {
+			return fmt.Errorf("verifyFlash: mismatch at offset 0x%x", address+i)
+		}
+	}
+
+	return nil
+}
+
+// restoreFlash writes saved back to flash at address and verifies it.
+// The progress callback is not called, so a restore triggered by
+// cancellation cannot itself be cancelled.
+func (dfu *Dfu) restoreFlash(address int, saved []byte) error {
+	progressCallback := dfu.progressCallback
+	dfu.progressCallback = nil
+	defer func() {
+		dfu.progressCallback = progressCallback
+	}()
+
+	err := dfu.enterDfuMode()
+	if err != nil {
+		return wrapError("restoreFlash", err)
+	}
+
+	err = dfu.writeFlashFrom(address, len(saved), bytes.NewReader(saved))
+	if err != nil {
+		return wrapError("restoreFlash", err)
+	}
+
+	err = dfu.verifyFlash(address, saved)
+	if err != nil {
+		return wrapError("restoreFlash", err)
+	}
+
+	return nil
+}
+
 func (dfu *Dfu) WriteMD380Users(db *userdb.UsersDB) error {
+	defer dfu.operation("WriteMD380Users")()
+
 	_, err := dfu.init()
 	if err != nil {
 		return wrapError("WriteMD380Users", err)
@@ -1252,6 +1712,8 @@ func (dfu *Dfu) WriteMD380Users(db *userdb.UsersDB) error {
 }
 
 func (dfu *Dfu) WriteRawMD380Users(rdr io.Reader, size int) error {
+	defer dfu.operation("WriteRawMD380Users")()
+
 	_, err := dfu.init()
 	if err != nil {
 		return wrapError("WriteRawMD380Users", err)
@@ -1272,6 +1734,8 @@ func (dfu *Dfu) WriteRawMD380Users(rdr io.Reader, size int) error {
 
 // this function is also used for writing the MD2017 users
 func (dfu *Dfu) WriteUV380Users(db *userdb.UsersDB) error {
+	defer dfu.operation("WriteUV380Users")()
+
 	image := db.UV380Image()
 
 	rdr := bytes.NewReader(image)
@@ -1294,13 +1758,102 @@ func (dfu *Dfu) WriteUV380Users(db *userdb.UsersDB) error {
 	return nil
 }
 
-func (dfu *Dfu) WriteFirmware(iRdr io.Reader) error {
+func (dfu *Dfu) WriteRawUV380Users(rdr io.Reader, size int) error {
+	defer dfu.operation("WriteRawUV380Users")()
+
+	_, err := dfu.init()
+	if err != nil {
+		return wrapError("WriteRawUV380Users", err)
+	}
+
+	err = dfu.writeFlashFrom(0x200000, size, rdr)
+	if err != nil {
+		return wrapError("WriteRawUV380Users", err)
+	}
+
+	err = dfu.md380Reboot()
+	if err != nil {
+		return wrapError("WriteRawUV380Users", err)
+	}
+
+	return nil
+}
+
+// WriteRawUsers writes size bytes read from rdr, a users database
+// image in the format used by the radio's model, as written by
+// WriteRawMD380Users or WriteRawUV380Users.  A users image does not
+// name a model, so the format is chosen from the radio's model, or
+// from the Model option if the radio's model is not in Profiles.  If
+// the model is still unknown, the Force option writes the image in
+// the MD380 format rather than returning an *UnknownModelError.  The
+// RequireSignature and Report options are as for WriteCodeplug.
+func (dfu *Dfu) WriteRawUsers(rdr io.Reader, size int, opts ...Option) error {
+	defer dfu.operation("WriteRawUsers")()
+
+	o := newOptions(opts)
+
+	data := make([]byte, size)
+	_, err := io.ReadFull(rdr, data)
+	if err != nil {
+		return wrapError("WriteRawUsers", err)
+	}
+
+	err = o.checkFile(data)
+	if err != nil {
+		return err
+	}
+
+	format := MD380Users
+	profile, err := dfu.radioProfile("WriteRawUsers", o)
+	switch {
+	case err == nil:
+		format = profile.UsersFormat
+	case !o.force:
+		return err
+	}
+
+	if format == UV380Users {
+		return dfu.WriteRawUV380Users(bytes.NewReader(data), size)
+	}
+
+	return dfu.WriteRawMD380Users(bytes.NewReader(data), size)
+}
+
+// WriteUsers writes db in the format used by the radio's model.
+func (dfu *Dfu) WriteUsers(db *userdb.UsersDB) error {
+	defer dfu.operation("WriteUsers")()
+
+	profile, err := dfu.radioProfile("WriteUsers", &options{})
+	if err != nil {
+		return err
+	}
+
+	if profile.UsersFormat == UV380Users {
+		return dfu.WriteUV380Users(db)
+	}
+
+	return dfu.WriteMD380Users(db)
+}
+
+// WriteFirmware writes the firmware image read from iRdr to a radio in
+// bootloader mode.  The image is read and validated in full before
+// anything is erased.  If the radio's model is known, from an earlier
+// call to Profile or from the Model option, a firmware header naming a
+// different model is refused with a *MismatchError, unless the Force
+// option is given.  The FirmwareFunc option may be used to report or
+// confirm what is about to be flashed, the Cipher option to encrypt a
+// plaintext image as the bootloader expects, and the Policy option to
+// restrict the images accepted.  The RequireSignature and Report
+// options are as for WriteCodeplug, applied to the firmware file.
+func (dfu *Dfu) WriteFirmware(iRdr io.Reader, opts ...Option) error {
+	defer dfu.operation("WriteFirmware")()
+
 	_, err := dfu.init()
 	if err != nil {
 		return wrapError("WriteFirmware", err)
 	}
 
-	return dfu.writeFirmwareFrom(iRdr)
+	return dfu.writeFirmwareFrom(iRdr, newOptions(opts))
 }
 
 func wrapError(prefix string, err error) error {
@@ -0,0 +1,208 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// codeplugSize is the size of a simulated MD380's codeplug.
+var codeplugSize = dfu.LookupProfile("MD380").CodeplugSize
+
+// testCodeplug returns a codeplug image whose bytes differ from block
+// to block, filled from seed.
+func testCodeplug(seed byte) []byte {
+	data := make([]byte, codeplugSize)
+	for i := range data {
+		data[i] = seed + byte(i) + byte(i>>10)
+	}
+
+	return data
+}
+
+// newRadio returns a simulated MD380 holding codeplug, and a Dfu for
+// it reporting progress to progressCallback.
+func newRadio(t *testing.T, codeplug []byte, progressCallback func(int) error) (*sim.Radio, *dfu.Dfu) {
+	radio := sim.New("MD380")
+	if codeplug != nil {
+		d, err := dfu.NewWithTransport(radio, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.WriteCodeplug(codeplug)
+		d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := dfu.NewWithTransport(radio, progressCallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return radio, d
+}
+
+// checkCodeplug fails the test unless the radio's whole codeplug,
+// through its last block, is want.
+func checkCodeplug(t *testing.T, radio *sim.Radio, want []byte) {
+	got := radio.Flash(0, len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("codeplug differs at offset 0x%x of 0x%x", i, len(want))
+		}
+	}
+}
+
+func TestWriteCodeplugAtomic(t *testing.T) {
+	radio, d := newRadio(t, testCodeplug(0), nil)
+	defer d.Close()
+
+	data := testCodeplug(0x80)
+	state, err := d.WriteCodeplugAtomic(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != dfu.CodeplugWritten {
+		t.Errorf("state is %s, want %s", state, dfu.CodeplugWritten)
+	}
+	checkCodeplug(t, radio, data)
+}
+
+func TestWriteCodeplugAtomicVerifyFailure(t *testing.T) {
+	original := testCodeplug(0)
+	radio, d := newRadio(t, original, nil)
+	defer d.Close()
+
+	radio.CorruptNextWrite(codeplugSize - 1)
+	state, err := d.WriteCodeplugAtomic(testCodeplug(0x80))
+	if err == nil {
+		t.Fatal("corrupted write succeeded")
+	}
+	if state != dfu.CodeplugRestored {
+		t.Errorf("state is %s, want %s: %s", state, dfu.CodeplugRestored, err)
+	}
+	checkCodeplug(t, radio, original)
+}
+
+func TestWriteCodeplugAtomicCancel(t *testing.T) {
+	original := testCodeplug(0)
+	errCanceled := errors.New("canceled")
+
+	var radio *sim.Radio
+	erasing := false
+	radio, d := newRadio(t, original, func(int) error {
+		// Cancel once the first block has been erased or rewritten.
+		if erasing || radio.Flash(0, 1)[0] != original[0] {
+			erasing = true
+			return errCanceled
+		}
+		return nil
+	})
+	defer d.Close()
+
+	state, err := d.WriteCodeplugAtomic(testCodeplug(0x80))
+	if err == nil {
+		t.Fatal("cancelled write succeeded")
+	}
+	if state != dfu.CodeplugRestored {
+		t.Errorf("state is %s, want %s: %s", state, dfu.CodeplugRestored, err)
+	}
+	checkCodeplug(t, radio, original)
+}
+
+func TestReadCodeplugAfterWrite(t *testing.T) {
+	data := testCodeplug(0x40)
+	_, d := newRadio(t, data, nil)
+	defer d.Close()
+
+	got := make([]byte, codeplugSize)
+	err := d.ReadCodeplug(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("codeplug read differs from the one written")
+	}
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestReadCodeplugAuto(t *testing.T) {
+	for _, model := range []string{"MD380", "UV380"} {
+		d, err := dfu.NewWithTransport(sim.New(model), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var w countingWriter
+		n, err := d.ReadCodeplugAuto(&w)
+		d.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", model, err)
+		}
+
+		want := dfu.LookupProfile(model).CodeplugSize
+		if n != want {
+			t.Errorf("%s: ReadCodeplugAuto returned %d, want %d", model, n, want)
+		}
+		if w.n != n {
+			t.Errorf("%s: ReadCodeplugAuto returned %d but wrote %d bytes", model, n, w.n)
+		}
+	}
+}
+
+func TestWriteSPIFlashTooLarge(t *testing.T) {
+	radio := sim.New("MD380")
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The simulated SPI flash holds 16MB.
+	size := 16*1024*1024 + 1024
+	err = d.WriteSPIFlash(bytes.NewReader(make([]byte, size)), size)
+	if err == nil || !strings.Contains(err.Error(), "flash too small") {
+		t.Fatalf("got error %v, want one refusing an image larger than the SPI flash", err)
+	}
+	if radio.SPIFlash(0, 1)[0] != 0xff {
+		t.Error("the SPI flash was written")
+	}
+}
@@ -30,8 +30,6 @@
 package dfu
 
 import (
-	"fmt"
-
 	"github.com/dalefarnsworth-dmr/stdfu"
 	"github.com/google/gousb"
 )
@@ -42,23 +40,24 @@ func New(progressCallback func(progressCounter int) error) (*Dfu, error) {
 		return nil, err
 	}
 
-	dfu := &Dfu{
-		stDfu:            stDfu,
-		progressCallback: progressCallback,
-		progressFunc:     func() error { return nil },
+	dfu, err := NewWithTransport(stdfuTransport{stDfu}, progressCallback)
+	if err != nil {
+		return nil, dfuModeError("New", err)
 	}
 
-	err = dfu.enterDfuMode()
-	if err != nil {
-		dfu.Close()
-		if err == gousb.ErrorPipe {
-			return nil, fmt.Errorf("Failed to enter Dfu mode.\nIs bootloader running?")
+	return dfu, nil
+}
+
+// dfuModeError returns the error for op when NewWithTransport fails
+// with err.  A stalled request means the radio must be power cycled.
+func dfuModeError(op string, err error) error {
+	if e, ok := err.(*enterDfuModeError); ok && e.err == gousb.ErrorPipe {
+		return &ActionRequiredError{
+			Op:     op,
+			Action: PowerCycle,
+			Reason: "the radio did not enter DFU mode",
 		}
-		return nil, err
 	}
 
-	dfu.blockSize = 1024
-	dfu.eraseBlockSize = 64 * 1024
-
-	return dfu, nil
+	return err
 }
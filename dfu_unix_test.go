@@ -0,0 +1,103 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package dfu
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+	"github.com/dalefarnsworth-dmr/stdfu"
+	"github.com/google/gousb"
+)
+
+// stallingTransport is a radio that stalls GetState, as one that has
+// stopped responding does.
+type stallingTransport struct {
+	*sim.Radio
+	err error
+}
+
+func (t stallingTransport) GetState() (stdfu.State, error) {
+	return 0, t.err
+}
+
+func TestDfuModeError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		powerCycle bool
+	}{
+		{"stall", gousb.ErrorPipe, true},
+		{"other error", errors.New("no such device"), false},
+	}
+
+	for _, test := range tests {
+		_, err := NewWithTransport(stallingTransport{sim.New("MD380"), test.err}, nil)
+		if err == nil {
+			t.Fatalf("%s: NewWithTransport succeeded", test.name)
+		}
+
+		err = dfuModeError("New", err)
+		e, ok := err.(*ActionRequiredError)
+		if ok != test.powerCycle || ok && e.Action != PowerCycle {
+			t.Errorf("%s: got %v, want power cycle %v", test.name, err, test.powerCycle)
+		}
+	}
+}
+
+func TestOpenPromptingPowerCycle(t *testing.T) {
+	radio := sim.New("MD380")
+	stalled := true
+
+	var actions []Action
+	p := PrompterFunc(func(p *Prompt) error {
+		actions = append(actions, p.Action)
+		stalled = false
+		return nil
+	})
+
+	d, err := openPrompting(context.Background(), p, func() (*Dfu, error) {
+		var t Transport = radio
+		if stalled {
+			t = stallingTransport{radio, gousb.ErrorPipe}
+		}
+		d, err := NewWithTransport(t, nil)
+		if err != nil {
+			return nil, dfuModeError("Open", err)
+		}
+		return d, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	if len(actions) != 1 || actions[0] != PowerCycle {
+		t.Errorf("prompted for %v, want [%v]", actions, PowerCycle)
+	}
+}
@@ -37,20 +37,5 @@ func New(progressCallback func(progressCounter int) error) (*Dfu, error) {
 		return nil, err
 	}
 
-	dfu := &Dfu{
-		stDfu:            stDfu,
-		progressCallback: progressCallback,
-		progressFunc:     func() error { return nil },
-	}
-
-	err = dfu.enterDfuMode()
-	if err != nil {
-		dfu.Close()
-		return nil, err
-	}
-
-	dfu.blockSize = 1024
-	dfu.eraseBlockSize = 64 * 1024
-
-	return dfu, nil
+	return NewWithTransport(stdfuTransport{stDfu}, progressCallback)
 }
@@ -0,0 +1,238 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// The DfuSe file format is described in ST's UM0391.
+const (
+	dfusePrefixSize  = 11
+	dfuseTargetSize  = 274
+	dfuseElementSize = 8
+	dfuseSuffixSize  = 16
+	dfuseNameSize    = 255
+	dfuseVersion     = 0x01
+	dfuseBcdDFU      = 0x011a
+)
+
+// DfuSeTarget is a target, or memory, in a DfuSe file.
+type DfuSeTarget struct {
+	AltSetting int    // the DFU interface alternate setting
+	Name       string // the target name, if any
+	Elements   []Segment
+}
+
+// DfuSeImage is a parsed DfuSe (.dfu) file.
+type DfuSeImage struct {
+	DeviceVersion int // bcdDevice from the suffix
+	ProductID     int
+	VendorID      int
+	Targets       []DfuSeTarget
+}
+
+// ReadDfuSe reads and parses a DfuSe file.
+func ReadDfuSe(rdr io.Reader) (*DfuSeImage, error) {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, wrapError("ReadDfuSe", err)
+	}
+
+	return ParseDfuSe(data)
+}
+
+// ParseDfuSe parses a DfuSe file, checking its structure and the
+// suffix CRC.
+func ParseDfuSe(data []byte) (*DfuSeImage, error) {
+	le := binary.LittleEndian
+
+	if len(data) < dfusePrefixSize+dfuseSuffixSize {
+		return nil, errors.New("ParseDfuSe: file too short")
+	}
+	if string(data[:5]) != "DfuSe" {
+		return nil, errors.New("ParseDfuSe: bad prefix signature")
+	}
+	if data[5] != dfuseVersion {
+		return nil, fmt.Errorf("ParseDfuSe: unsupported version %d", data[5])
+	}
+
+	suffix := data[len(data)-dfuseSuffixSize:]
+	if string(suffix[8:11]) != "UFD" || int(suffix[11]) != dfuseSuffixSize {
+		return nil, errors.New("ParseDfuSe: bad suffix signature")
+	}
+	crc := le.Uint32(suffix[12:])
+	if crc != dfuseCRC(data[:len(data)-4]) {
+		return nil, errors.New("ParseDfuSe: bad CRC")
+	}
+
+	imageSize := int(le.Uint32(data[6:]))
+	if imageSize != len(data)-dfuseSuffixSize {
+		return nil, fmt.Errorf("ParseDfuSe: prefix image size %d does not match file size %d", imageSize+dfuseSuffixSize, len(data))
+	}
+
+	img := &DfuSeImage{
+		DeviceVersion: int(le.Uint16(suffix[0:])),
+		ProductID:     int(le.Uint16(suffix[2:])),
+		VendorID:      int(le.Uint16(suffix[4:])),
+	}
+
+	targetCount := int(data[10])
+	rest := data[dfusePrefixSize:imageSize]
+	for i := 0; i < targetCount; i++ {
+		if len(rest) < dfuseTargetSize {
+			return nil, fmt.Errorf("ParseDfuSe: target %d: truncated", i)
+		}
+		if string(rest[:6]) != "Target" {
+			return nil, fmt.Errorf("ParseDfuSe: target %d: bad signature", i)
+		}
+
+		target := DfuSeTarget{
+			AltSetting: int(rest[6]),
+		}
+		if le.Uint32(rest[7:]) != 0 {
+			target.Name = string(bytes.TrimRight(rest[11:11+dfuseNameSize], "\x00"))
+		}
+		targetSize := int(le.Uint32(rest[266:]))
+		elementCount := int(le.Uint32(rest[270:]))
+
+		rest = rest[dfuseTargetSize:]
+		if targetSize > len(rest) {
+			return nil, fmt.Errorf("ParseDfuSe: target %d: size %d exceeds file", i, targetSize)
+		}
+		elements := rest[:targetSize]
+		rest = rest[targetSize:]
+
+		for j := 0; j < elementCount; j++ {
+			if len(elements) < dfuseElementSize {
+				return nil, fmt.Errorf("ParseDfuSe: target %d element %d: truncated", i, j)
+			}
+			address := int(le.Uint32(elements[0:]))
+			size := int(le.Uint32(elements[4:]))
+			elements = elements[dfuseElementSize:]
+			if size > len(elements) {
+				return nil, fmt.Errorf("ParseDfuSe: target %d element %d: size %d exceeds target", i, j, size)
+			}
+
+			target.Elements = append(target.Elements, Segment{
+				Address: address,
+				Data:    elements[:size],
+			})
+			elements = elements[size:]
+		}
+		if len(elements) != 0 {
+			return nil, fmt.Errorf("ParseDfuSe: target %d: size does not match its elements", i)
+		}
+
+		img.Targets = append(img.Targets, target)
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("ParseDfuSe: extra data after targets")
+	}
+
+	return img, nil
+}
+
+// Bytes returns img in the DfuSe file format.
+func (img *DfuSeImage) Bytes() []byte {
+	le := binary.LittleEndian
+
+	data := make([]byte, dfusePrefixSize)
+	copy(data, "DfuSe")
+	data[5] = dfuseVersion
+	data[10] = byte(len(img.Targets))
+
+	for _, target := range img.Targets {
+		targetSize := 0
+		for _, elem := range target.Elements {
+			targetSize += dfuseElementSize + len(elem.Data)
+		}
+
+		prefix := make([]byte, dfuseTargetSize)
+		copy(prefix, "Target")
+		prefix[6] = byte(target.AltSetting)
+		if target.Name != "" {
+			le.PutUint32(prefix[7:], 1)
+			copy(prefix[11:11+dfuseNameSize], target.Name)
+		}
+		le.PutUint32(prefix[266:], uint32(targetSize))
+		le.PutUint32(prefix[270:], uint32(len(target.Elements)))
+		data = append(data, prefix...)
+
+		for _, elem := range target.Elements {
+			header := make([]byte, dfuseElementSize)
+			le.PutUint32(header[0:], uint32(elem.Address))
+			le.PutUint32(header[4:], uint32(len(elem.Data)))
+			data = append(data, header...)
+			data = append(data, elem.Data...)
+		}
+	}
+	le.PutUint32(data[6:], uint32(len(data)))
+
+	data = append(data, dfuseSuffix(img.DeviceVersion, img.ProductID, img.VendorID)...)
+	le.PutUint32(data[len(data)-4:], dfuseCRC(data[:len(data)-4]))
+
+	return data
+}
+
+// WriteTo writes img in the DfuSe file format to w.
+func (img *DfuSeImage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(img.Bytes())
+	return int64(n), err
+}
+
+// dfuseSuffix returns a DfuSe suffix with a zero CRC.
+func dfuseSuffix(device, product, vendor int) []byte {
+	suffix := make([]byte, dfuseSuffixSize)
+	le := binary.LittleEndian
+	le.PutUint16(suffix[0:], uint16(device))
+	le.PutUint16(suffix[2:], uint16(product))
+	le.PutUint16(suffix[4:], uint16(vendor))
+	le.PutUint16(suffix[6:], dfuseBcdDFU)
+	copy(suffix[8:], "UFD")
+	suffix[11] = dfuseSuffixSize
+
+	return suffix
+}
+
+// dfuseCRC returns the CRC stored in a DfuSe suffix, computed over data,
+// the whole file except the CRC itself.
+func dfuseCRC(data []byte) uint32 {
+	return ^crc32.ChecksumIEEE(data)
+}
+
+// WriteDfuSe writes the internal flash target of img to a radio in
+// bootloader mode, each element at its own address.  It is equivalent
+// to passing img's file contents to WriteFirmware.
+func (dfu *Dfu) WriteDfuSe(img *DfuSeImage, opts ...Option) error {
+	defer dfu.operation("WriteDfuSe")()
+
+	return dfu.WriteFirmware(bytes.NewReader(img.Bytes()), opts...)
+}
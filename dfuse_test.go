@@ -0,0 +1,215 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// dfuseCRC computes a DfuSe suffix CRC bit by bit, as given in the DFU
+// specification: a CRC-32 without the final inversion.
+func dfuseCRC(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xedb88320
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// fixCRC stores the correct CRC in the suffix of file.
+func fixCRC(file []byte) []byte {
+	binary.LittleEndian.PutUint32(file[len(file)-4:], dfuseCRC(file[:len(file)-4]))
+	return file
+}
+
+// testDfuSe returns a DfuSe file, built by hand as laid out in UM0391,
+// with two targets: a named one holding two elements and an unnamed
+// one holding one.
+func testDfuSe() []byte {
+	le := binary.LittleEndian
+	u32 := func(v int) []byte {
+		b := make([]byte, 4)
+		le.PutUint32(b, uint32(v))
+		return b
+	}
+	target := func(alt int, name string, elements ...[]byte) []byte {
+		size := 0
+		for _, e := range elements {
+			size += len(e)
+		}
+		t := append([]byte("Target"), byte(alt))
+		named := 0
+		if name != "" {
+			named = 1
+		}
+		t = append(t, u32(named)...)
+		nameField := make([]byte, 255)
+		copy(nameField, name)
+		t = append(t, nameField...)
+		t = append(t, u32(size)...)
+		t = append(t, u32(len(elements))...)
+		for _, e := range elements {
+			t = append(t, e...)
+		}
+		return t
+	}
+	element := func(address int, data string) []byte {
+		return append(append(u32(address), u32(len(data))...), data...)
+	}
+
+	file := append([]byte("DfuSe\x01"), 0, 0, 0, 0, 2)
+	file = append(file, target(0, "Internal Flash",
+		element(0x0800c000, "first"),
+		element(0x08020000, "second element"))...)
+	file = append(file, target(1, "", element(0x1fffc000, "option"))...)
+	le.PutUint32(file[6:], uint32(len(file)))
+
+	// bcdDevice, idProduct, idVendor, bcdDFU, "UFD", bLength, dwCRC
+	file = append(file, 0x00, 0x02, 0x11, 0xdf, 0x83, 0x04, 0x1a, 0x01)
+	file = append(file, 'U', 'F', 'D', 16, 0, 0, 0, 0)
+
+	return fixCRC(file)
+}
+
+func TestParseDfuSe(t *testing.T) {
+	file := testDfuSe()
+
+	img, err := dfu.ParseDfuSe(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.DeviceVersion != 0x0200 || img.ProductID != 0xdf11 || img.VendorID != 0x0483 {
+		t.Errorf("suffix is device %04x, product %04x, vendor %04x", img.DeviceVersion, img.ProductID, img.VendorID)
+	}
+	if len(img.Targets) != 2 {
+		t.Fatalf("%d targets, want 2", len(img.Targets))
+	}
+
+	want := []struct {
+		alt      int
+		name     string
+		elements []dfu.Segment
+	}{
+		{0, "Internal Flash", []dfu.Segment{
+			{Address: 0x0800c000, Data: []byte("first")},
+			{Address: 0x08020000, Data: []byte("second element")},
+		}},
+		{1, "", []dfu.Segment{
+			{Address: 0x1fffc000, Data: []byte("option")},
+		}},
+	}
+	for i, w := range want {
+		target := img.Targets[i]
+		if target.AltSetting != w.alt || target.Name != w.name {
+			t.Errorf("target %d is alt %d %q, want alt %d %q", i, target.AltSetting, target.Name, w.alt, w.name)
+		}
+		if len(target.Elements) != len(w.elements) {
+			t.Errorf("target %d has %d elements, want %d", i, len(target.Elements), len(w.elements))
+			continue
+		}
+		for j, e := range w.elements {
+			got := target.Elements[j]
+			if got.Address != e.Address || !bytes.Equal(got.Data, e.Data) {
+				t.Errorf("target %d element %d is %q at 0x%08x", i, j, got.Data, got.Address)
+			}
+		}
+	}
+
+	if !bytes.Equal(img.Bytes(), file) {
+		t.Error("Bytes does not reproduce the file")
+	}
+}
+
+func TestParseDfuSeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(file []byte) []byte
+	}{
+		{"corrupted", func(file []byte) []byte {
+			file[300] ^= 0xff
+			return file
+		}},
+		{"CRC", func(file []byte) []byte {
+			file[len(file)-1] ^= 0xff
+			return file
+		}},
+		{"short", func(file []byte) []byte {
+			return fixCRC(file[len(file)-20:])
+		}},
+		{"prefix signature", func(file []byte) []byte {
+			file[0] = 'd'
+			return fixCRC(file)
+		}},
+		{"version", func(file []byte) []byte {
+			file[5] = 2
+			return fixCRC(file)
+		}},
+		{"suffix signature", func(file []byte) []byte {
+			file[len(file)-8] = 'X'
+			return fixCRC(file)
+		}},
+		{"image size", func(file []byte) []byte {
+			file[6]++
+			return fixCRC(file)
+		}},
+		{"target count", func(file []byte) []byte {
+			file[10] = 3
+			return fixCRC(file)
+		}},
+		{"target signature", func(file []byte) []byte {
+			file[11] = 't'
+			return fixCRC(file)
+		}},
+		{"element size", func(file []byte) []byte {
+			// The second element of the first target claims more
+			// data than the target holds.
+			file[11+274+8+5+4] = 0xff
+			return fixCRC(file)
+		}},
+		{"extra data", func(file []byte) []byte {
+			file[10] = 1
+			return fixCRC(file)
+		}},
+	}
+
+	for _, test := range tests {
+		_, err := dfu.ParseDfuSe(test.modify(testDfuSe()))
+		if err == nil {
+			t.Errorf("%s: bad file accepted", test.name)
+		}
+	}
+}
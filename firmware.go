@@ -0,0 +1,347 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+)
+
+// The application firmware lives above the bootloader, in internal
+// flash, and begins with its vector table.
+const (
+	flashBase  = 0x08000000
+	flashEnd   = 0x08200000
+	appBase    = 0x0800c000
+	sramBase   = 0x20000000
+	sramEnd    = 0x20020000
+	ccmramBase = 0x10000000
+	ccmramEnd  = 0x10010000
+)
+
+// md380toolsMarker is found in the text of firmware patched by md380tools.
+const md380toolsMarker = "md380tools"
+
+// FirmwareKind identifies the container a firmware image came in.
+type FirmwareKind int
+
+const (
+	FirmwarePlain      FirmwareKind = iota // a raw image, starting with its vector table
+	FirmwareTYT                            // a TYT-wrapped vendor image
+	FirmwareMD380Tools                     // a raw image patched by md380tools
+	FirmwareDfuSe                          // a DfuSe (.dfu) file
+	FirmwareIntelHex                       // an Intel HEX file
+	FirmwareSRecord                        // a Motorola S-record file
+)
+
+func (kind FirmwareKind) String() string {
+	switch kind {
+	case FirmwarePlain:
+		return "plain"
+	case FirmwareTYT:
+		return "TYT"
+	case FirmwareMD380Tools:
+		return "md380tools"
+	case FirmwareDfuSe:
+		return "DfuSe"
+	case FirmwareIntelHex:
+		return "Intel HEX"
+	case FirmwareSRecord:
+		return "S-record"
+	}
+
+	return fmt.Sprintf("FirmwareKind(%d)", int(kind))
+}
+
+// Segment is a contiguous run of data to be written at Address.
+type Segment struct {
+	Address int
+	Data    []byte
+}
+
+// Firmware is a parsed firmware file.
+type Firmware struct {
+	Kind    FirmwareKind
+	Header  *firmware.Header // the TYT header, for a TYT-wrapped image
+	Version string           // version recorded in a DfuSe suffix, if any
+	Address int              // load address of the payload, or of the lowest segment
+	Length  int              // payload length, or the total length of the segments
+	Payload []byte           // the image to be flashed, without header or footer
+	SHA256  string           // lower-case hex SHA-256 of the whole file
+
+	// Segments holds the images to be flashed, in address order, for
+	// formats that name several addresses.  Payload is then nil.
+	Segments []Segment
+}
+
+// segments returns the segments to be flashed for fw.
+func (fw *Firmware) segments() []Segment {
+	if fw.Segments != nil {
+		return fw.Segments
+	}
+
+	return []Segment{{fw.Address, fw.Payload}}
+}
+
+// newSegmentedFirmware returns a Firmware of the given kind holding
+// segments, which are sorted by address.
+func newSegmentedFirmware(kind FirmwareKind, segments []Segment) *Firmware {
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Address < segments[j].Address
+	})
+
+	fw := &Firmware{
+		Kind:     kind,
+		Segments: segments,
+	}
+	if len(segments) > 0 {
+		fw.Address = segments[0].Address
+	}
+	for _, seg := range segments {
+		fw.Length += len(seg.Data)
+	}
+
+	return fw
+}
+
+func (fw *Firmware) String() string {
+	s := fmt.Sprintf("%s firmware, %d bytes at 0x%08x", fw.Kind, fw.Length, fw.Address)
+	if fw.Header != nil {
+		s += fmt.Sprintf(", radio %x", bytes.TrimRight(fw.Header.Radio, "\x00\xff"))
+	}
+	if fw.Version != "" {
+		s += ", version " + fw.Version
+	}
+
+	return s
+}
+
+// ReadFirmware reads and parses a firmware file.
+func ReadFirmware(rdr io.Reader) (*Firmware, error) {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, wrapError("ReadFirmware", err)
+	}
+
+	return ParseFirmware(data)
+}
+
+// ParseFirmware parses a plain, md380tools-patched, TYT-wrapped, DfuSe,
+// Intel HEX or S-record firmware file.  The TYT header and footer are
+// stripped and the header is checked for consistency with the file.
+// Only a DfuSe file's internal flash target, alternate setting 0, is
+// accepted.
+func ParseFirmware(data []byte) (*Firmware, error) {
+	fw, err := parseFirmware(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	fw.SHA256 = hex.EncodeToString(sum[:])
+
+	return fw, nil
+}
+
+func parseFirmware(data []byte) (*Firmware, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(":")):
+		segments, err := ParseIntelHex(data)
+		if err != nil {
+			return nil, wrapError("ParseFirmware", err)
+		}
+		return newSegmentedFirmware(FirmwareIntelHex, segments), nil
+
+	case len(data) > 1 && data[0] == 'S' && data[1] >= '0' && data[1] <= '9':
+		segments, err := ParseSRecord(data)
+		if err != nil {
+			return nil, wrapError("ParseFirmware", err)
+		}
+		return newSegmentedFirmware(FirmwareSRecord, segments), nil
+	}
+
+	if bytes.HasPrefix(data, []byte("DfuSe")) {
+		img, err := ParseDfuSe(data)
+		if err != nil {
+			return nil, wrapError("ParseFirmware", err)
+		}
+
+		var segments []Segment
+		for _, target := range img.Targets {
+			if target.AltSetting != 0 {
+				return nil, fmt.Errorf("ParseFirmware: DfuSe target %q is not internal flash", target.Name)
+			}
+			segments = append(segments, target.Elements...)
+		}
+
+		fw := newSegmentedFirmware(FirmwareDfuSe, segments)
+		fw.Version = dfuseFirmwareVersion(img.DeviceVersion)
+
+		return fw, nil
+	}
+
+	if !bytes.HasPrefix(data, []byte(firmware.HeaderMagic)) {
+		kind := FirmwarePlain
+		if bytes.Contains(bytes.ToLower(data), []byte(md380toolsMarker)) {
+			kind = FirmwareMD380Tools
+		}
+
+		fw := &Firmware{
+			Kind:    kind,
+			Address: appBase,
+			Length:  len(data),
+			Payload: data,
+		}
+
+		return fw, nil
+	}
+
+	header, err := firmware.ParseHeader(data)
+	if err != nil {
+		return nil, wrapError("ParseFirmware", err)
+	}
+
+	fw := &Firmware{
+		Kind:    FirmwareTYT,
+		Header:  header,
+		Address: header.Address,
+		Length:  header.Length,
+		Payload: data[firmware.HeaderSize : firmware.HeaderSize+header.Length],
+	}
+
+	return fw, nil
+}
+
+// dfuseFirmwareVersion returns the firmware version recorded, in BCD,
+// in a DfuSe suffix's bcdDevice, or "" if the file records none.
+func dfuseFirmwareVersion(bcd int) string {
+	if bcd == 0xffff || bcd == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x.%02x", bcd>>8, bcd&0xff)
+}
+
+// validateFirmware checks that fw fits the flash sectors in blocks,
+// without overlapping segments, and that it starts with a plausible
+// vector table.  The payload of a TYT-wrapped image is encrypted, so
+// its vector table cannot be checked, and a segmented image that does
+// not reach the start of flash leaves the vector table as it is.
+//
+// If model is not empty, a TYT-wrapped image whose header names
+// hardware other than that model's is refused with a *MismatchError.
+func validateFirmware(fw *Firmware, blocks []block, model string) error {
+	if fw.Length == 0 {
+		return errors.New("validateFirmware: empty firmware image")
+	}
+
+	start := blocks[0].address
+	last := blocks[len(blocks)-1]
+	end := last.address + last.size
+
+	segments := fw.segments()
+	for i, seg := range segments {
+		segEnd := seg.Address + len(seg.Data)
+		if seg.Address < start && segEnd > flashBase {
+			return fmt.Errorf("validateFirmware: image at 0x%08x-0x%08x overlaps the bootloader", seg.Address, segEnd)
+		}
+		if seg.Address < start || segEnd > end {
+			return fmt.Errorf("validateFirmware: image at 0x%08x-0x%08x is outside flash at 0x%08x-0x%08x", seg.Address, segEnd, start, end)
+		}
+		if i > 0 && seg.Address < segments[i-1].Address+len(segments[i-1].Data) {
+			return fmt.Errorf("validateFirmware: image segments overlap at 0x%08x", seg.Address)
+		}
+	}
+
+	// An Intel HEX, S-record or DfuSe image may patch only part of
+	// the firmware, leaving the vector table as it is.
+	if fw.Kind != FirmwareTYT && (fw.Segments == nil || segmentData(segments, start) != nil) {
+		err := checkVectorTable(segments, start)
+		if err != nil {
+			return wrapError("validateFirmware", err)
+		}
+	}
+
+	profile := LookupProfile(model)
+	if fw.Header != nil && profile != nil && profile.FirmwareRadio != nil {
+		if !bytes.HasPrefix(fw.Header.Radio, profile.FirmwareRadio) {
+			return &MismatchError{
+				Op:     "WriteFirmware",
+				Model:  model,
+				Reason: fmt.Sprintf("firmware header names radio %x", bytes.TrimRight(fw.Header.Radio, "\x00\xff")),
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkVectorTable checks that segments place a plausible initial stack
+// pointer and reset address at address, with the reset address inside
+// one of the segments.
+func checkVectorTable(segments []Segment, address int) error {
+	table := segmentData(segments, address)
+	if len(table) < 8 {
+		return fmt.Errorf("no vector table at 0x%08x", address)
+	}
+
+	sp := int(binary.LittleEndian.Uint32(table[0:]))
+	if !(sp > sramBase && sp <= sramEnd) && !(sp > ccmramBase && sp <= ccmramEnd) {
+		return fmt.Errorf("initial stack pointer 0x%08x is not in RAM", sp)
+	}
+
+	reset := int(binary.LittleEndian.Uint32(table[4:]))
+	if reset&1 == 0 {
+		return fmt.Errorf("reset address 0x%08x is not a thumb address", reset)
+	}
+	reset &^= 1
+	for _, seg := range segments {
+		if reset >= seg.Address && reset < seg.Address+len(seg.Data) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("reset address 0x%08x is outside the image", reset)
+}
+
+// segmentData returns the data segments hold from address to the end
+// of the segment containing it, or nil if no segment contains address.
+func segmentData(segments []Segment, address int) []byte {
+	for _, seg := range segments {
+		if address >= seg.Address && address < seg.Address+len(seg.Data) {
+			return seg.Data[address-seg.Address:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// This code began as a transliteration of the python code found in
+// https://github.com/travisgoodspeed/md380tools.
+
+// Package firmware converts TYT vendor firmware images between the
+// encrypted form in which they are distributed and written by the
+// bootloader, and plaintext suitable for inspection and patching.
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the size of the key used to encrypt vendor firmware.
+const KeySize = 1024
+
+// The header and footer of a vendor firmware file, as laid out by
+// md380tools' md380_fw.py.  The header holds a magic string, the JST51
+// marker, a field identifying the radio hardware, a list of the flash
+// regions the image fills, and the load address and length of the
+// payload.  The footer holds only its magic string.  Unused bytes are
+// 0xff.
+const (
+	HeaderSize    = 0x100
+	FooterSize    = 0x100
+	HeaderMagic   = "OutSecurityBin"
+	FooterMagic   = "OutputBinDataEnd"
+	MarkerOffset  = 0x10
+	MarkerSize    = 7
+	Marker        = "JST51"
+	RadioOffset   = 0x20
+	RadioSize     = 16
+	RegionsOffset = 0x30
+	RegionsSize   = 33
+	AddressOffset = 0x80
+	LengthOffset  = 0x84
+)
+
+// The application firmware is loaded into the radio's internal flash.
+const (
+	flashBase = 0x08000000
+	flashEnd  = 0x08200000
+)
+
+// MD380Radio is the radio field md380_fw.py writes for MD380-family
+// firmware.
+var MD380Radio = []byte{0x30, 0x02, 0x00, 0x30, 0x00, 0x40, 0x00, 0x47}
+
+// MD380Regions is the regions field md380_fw.py writes for MD380-family
+// firmware.
+var MD380Regions = []byte{
+	0x01, 0x0d, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+	0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17,
+	0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+	0x20,
+}
+
+// Header holds the fields of a vendor firmware file's header.
+type Header struct {
+	Radio   []byte // RadioSize bytes identifying the radio hardware
+	Regions []byte // RegionsSize bytes listing the flash regions filled
+	Address int    // load address of the payload
+	Length  int    // length of the payload
+}
+
+// ParseHeader parses the header of a vendor firmware file.  It checks
+// the header and footer magic strings and the marker, and that the
+// payload fills the rest of the file and lies within flash.
+func ParseHeader(file []byte) (*Header, error) {
+	if len(file) < HeaderSize+FooterSize {
+		return nil, errors.New("ParseHeader: file too short for its header")
+	}
+	if string(file[:len(HeaderMagic)]) != HeaderMagic {
+		return nil, errors.New("ParseHeader: bad header signature")
+	}
+	if string(file[MarkerOffset:MarkerOffset+len(Marker)]) != Marker {
+		return nil, fmt.Errorf("ParseHeader: missing %s marker", Marker)
+	}
+
+	footer := file[len(file)-FooterSize:]
+	if string(footer[:len(FooterMagic)]) != FooterMagic {
+		return nil, errors.New("ParseHeader: missing footer")
+	}
+
+	h := &Header{
+		Radio:   file[RadioOffset : RadioOffset+RadioSize],
+		Regions: file[RegionsOffset : RegionsOffset+RegionsSize],
+		Address: int(binary.LittleEndian.Uint32(file[AddressOffset:])),
+		Length:  int(binary.LittleEndian.Uint32(file[LengthOffset:])),
+	}
+
+	if h.Length != len(file)-HeaderSize-FooterSize {
+		return nil, fmt.Errorf("ParseHeader: header payload length %d does not match file size %d", h.Length, len(file))
+	}
+	if h.Address < flashBase || h.Address+h.Length > flashEnd {
+		return nil, fmt.Errorf("ParseHeader: payload at 0x%08x-0x%08x is not in flash", h.Address, h.Address+h.Length)
+	}
+
+	return h, nil
+}
+
+// A Cipher encrypts and decrypts firmware payloads.  The vendor
+// transformation is an exclusive-or with a repeating KeySize-byte key,
+// so encryption and decryption are the same operation.
+//
+// The key is not distributed with this package.  It is the hex string
+// assigned to key in the MD380FW class of md380tools' md380_fw.py, and
+// DeriveKey recovers it from any vendor image and its plaintext, such
+// as "md380-fw --unwrap" produces.
+type Cipher struct {
+	key []byte
+}
+
+// NewCipher returns a Cipher using key, which must be KeySize bytes.
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("NewCipher: key size is %d, want %d", len(key), KeySize)
+	}
+
+	c := &Cipher{
+		key: append([]byte(nil), key...),
+	}
+
+	return c, nil
+}
+
+// DeriveKey returns the key with which encrypted, the payload of a
+// vendor firmware file, was made from plain.  Both must hold at least
+// KeySize bytes.
+func DeriveKey(encrypted, plain []byte) ([]byte, error) {
+	if len(encrypted) < KeySize || len(plain) < KeySize {
+		return nil, fmt.Errorf("DeriveKey: need %d bytes of payload and plaintext", KeySize)
+	}
+
+	key := make([]byte, KeySize)
+	for i := range key {
+		key[i] = encrypted[i] ^ plain[i]
+	}
+
+	return key, nil
+}
+
+// Decrypt returns the plaintext of an encrypted payload.
+func (c *Cipher) Decrypt(payload []byte) []byte {
+	return c.xor(payload)
+}
+
+// Encrypt returns the encrypted form of a plaintext payload.
+func (c *Cipher) Encrypt(payload []byte) []byte {
+	return c.xor(payload)
+}
+
+func (c *Cipher) xor(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ c.key[i%len(c.key)]
+	}
+
+	return out
+}
+
+// Unwrap strips the header and footer from a vendor firmware file and
+// returns the decrypted payload and its load address.
+func (c *Cipher) Unwrap(file []byte) (plain []byte, address int, err error) {
+	h, err := ParseHeader(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plain = c.Decrypt(file[HeaderSize : HeaderSize+h.Length])
+
+	return plain, h.Address, nil
+}
+
+// Wrap encrypts plain, to be loaded at address, and adds the header
+// and footer expected by the vendor tools and the bootloader, naming
+// the MD380 family as md380_fw.py does.
+func (c *Cipher) Wrap(plain []byte, address int) []byte {
+	header := bytes.Repeat([]byte{0xff}, HeaderSize)
+	putField(header[:MarkerOffset], []byte(HeaderMagic))
+	putField(header[MarkerOffset:MarkerOffset+MarkerSize], []byte(Marker))
+	putField(header[RadioOffset:RadioOffset+RadioSize], MD380Radio)
+	putField(header[RegionsOffset:RegionsOffset+RegionsSize], MD380Regions)
+	binary.LittleEndian.PutUint32(header[AddressOffset:], uint32(address))
+	binary.LittleEndian.PutUint32(header[LengthOffset:], uint32(len(plain)))
+
+	footer := bytes.Repeat([]byte{0xff}, FooterSize)
+	putField(footer[:len(FooterMagic)], []byte(FooterMagic))
+
+	file := make([]byte, 0, HeaderSize+len(plain)+FooterSize)
+	file = append(file, header...)
+	file = append(file, c.Encrypt(plain)...)
+	file = append(file, footer...)
+
+	return file
+}
+
+// putField copies value into field and pads it with zeros.
+func putField(field, value []byte) {
+	n := copy(field, value)
+	for i := n; i < len(field); i++ {
+		field[i] = 0
+	}
+}
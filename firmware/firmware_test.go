@@ -0,0 +1,168 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package firmware_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+)
+
+// testKey returns a KeySize-byte key.  The vendor key is not
+// distributed with this package, so the tests use one of their own.
+func testKey() []byte {
+	key := make([]byte, firmware.KeySize)
+	for i := range key {
+		key[i] = byte(i*7) ^ byte(i>>8)
+	}
+
+	return key
+}
+
+// wrapped returns a vendor firmware file as md380_fw.py's wrap lays
+// it out, with the struct formats "<16s7s9s16s33s47sLL120s" and
+// "<16s240s" around the already encrypted payload.
+func wrapped(encrypted []byte, address int) []byte {
+	field := func(value []byte, size int) []byte {
+		f := make([]byte, size)
+		copy(f, value)
+		return f
+	}
+	word := func(v int) []byte {
+		w := make([]byte, 4)
+		binary.LittleEndian.PutUint32(w, uint32(v))
+		return w
+	}
+	ff := func(n int) []byte {
+		return bytes.Repeat([]byte{0xff}, n)
+	}
+
+	var file []byte
+	file = append(file, field([]byte("OutSecurityBin"), 16)...)
+	file = append(file, field([]byte("JST51"), 7)...)
+	file = append(file, ff(9)...)
+	file = append(file, field([]byte{0x30, 0x02, 0x00, 0x30, 0x00, 0x40, 0x00, 0x47}, 16)...)
+	file = append(file, firmware.MD380Regions...)
+	file = append(file, ff(47)...)
+	file = append(file, word(address)...)
+	file = append(file, word(len(encrypted))...)
+	file = append(file, ff(120)...)
+	file = append(file, encrypted...)
+	file = append(file, field([]byte("OutputBinDataEnd"), 16)...)
+	file = append(file, ff(240)...)
+
+	return file
+}
+
+func TestWrap(t *testing.T) {
+	key := testKey()
+	c, err := firmware.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := make([]byte, 3000)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	encrypted := make([]byte, len(plain))
+	for i := range plain {
+		encrypted[i] = plain[i] ^ key[i%len(key)]
+	}
+
+	file := c.Wrap(plain, 0x0800c000)
+	want := wrapped(encrypted, 0x0800c000)
+	if !bytes.Equal(file, want) {
+		for i := range file {
+			if i >= len(want) || file[i] != want[i] {
+				t.Fatalf("wrapped file differs from md380_fw.py's layout at offset 0x%x", i)
+			}
+		}
+		t.Fatalf("wrapped file is %d bytes, want %d", len(file), len(want))
+	}
+
+	got, address, err := c.Unwrap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != 0x0800c000 {
+		t.Errorf("address is 0x%08x, want 0x0800c000", address)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("unwrapped payload differs from the plaintext")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	c, err := firmware.NewCipher(testKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := bytes.Repeat([]byte("md380tools"), 200)
+	file := c.Wrap(plain, 0x0800c000)
+
+	key, err := firmware.DeriveKey(file[firmware.HeaderSize:], plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, testKey()) {
+		t.Error("derived key differs from the key used")
+	}
+
+	_, err = firmware.DeriveKey(file[firmware.HeaderSize:], plain[:firmware.KeySize-1])
+	if err == nil {
+		t.Error("key derived from a short plaintext")
+	}
+}
+
+func TestNewCipherKeySize(t *testing.T) {
+	_, err := firmware.NewCipher(make([]byte, firmware.KeySize-1))
+	if err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	file := wrapped(make([]byte, 512), 0x0800c000)
+
+	h, err := firmware.ParseHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Address != 0x0800c000 || h.Length != 512 {
+		t.Errorf("payload is %d bytes at 0x%08x, want 512 at 0x0800c000", h.Length, h.Address)
+	}
+	if !bytes.HasPrefix(h.Radio, firmware.MD380Radio) {
+		t.Errorf("radio field is %x", h.Radio)
+	}
+
+	copy(file[firmware.MarkerOffset:], "XXXXX")
+	_, err = firmware.ParseHeader(file)
+	if err == nil {
+		t.Error("header without the JST51 marker accepted")
+	}
+}
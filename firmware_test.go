@@ -0,0 +1,276 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+const appBase = 0x0800c000
+
+// testFirmware returns a TYT-wrapped image of a plain application
+// that starts with a vector table, encrypted with an arbitrary key.
+func testFirmware(t *testing.T) []byte {
+	plain := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(plain[0:], 0x20020000)
+	binary.LittleEndian.PutUint32(plain[4:], appBase+0x101)
+
+	c, err := firmware.NewCipher(bytes.Repeat([]byte{0x5a}, firmware.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.Wrap(plain, appBase)
+}
+
+func TestParseFirmwareTYT(t *testing.T) {
+	file := testFirmware(t)
+
+	fw, err := dfu.ParseFirmware(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fw.Kind != dfu.FirmwareTYT {
+		t.Errorf("kind is %s, want TYT", fw.Kind)
+	}
+	if fw.Address != appBase || fw.Length != 1024 {
+		t.Errorf("payload is %d bytes at 0x%08x, want 1024 at 0x%08x", fw.Length, fw.Address, appBase)
+	}
+	if !bytes.Equal(fw.Payload, file[firmware.HeaderSize:firmware.HeaderSize+1024]) {
+		t.Error("payload is not the file between header and footer")
+	}
+	if !bytes.HasPrefix(fw.Header.Radio, firmware.MD380Radio) {
+		t.Errorf("radio field is %x", fw.Header.Radio)
+	}
+	if !bytes.Equal(fw.Header.Regions, firmware.MD380Regions) {
+		t.Errorf("regions field is %x", fw.Header.Regions)
+	}
+}
+
+func TestParseFirmwareBadHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(file []byte) []byte
+	}{
+		{"marker", func(file []byte) []byte {
+			copy(file[firmware.MarkerOffset:], "JST50")
+			return file
+		}},
+		{"length", func(file []byte) []byte {
+			binary.LittleEndian.PutUint32(file[firmware.LengthOffset:], 2048)
+			return file
+		}},
+		{"address", func(file []byte) []byte {
+			binary.LittleEndian.PutUint32(file[firmware.AddressOffset:], 0x20000000)
+			return file
+		}},
+		{"end", func(file []byte) []byte {
+			binary.LittleEndian.PutUint32(file[firmware.AddressOffset:], 0x081fff00)
+			return file
+		}},
+		{"footer", func(file []byte) []byte {
+			file[len(file)-firmware.FooterSize] = 'X'
+			return file
+		}},
+		{"truncated", func(file []byte) []byte {
+			return file[:len(file)-1]
+		}},
+	}
+
+	for _, test := range tests {
+		_, err := dfu.ParseFirmware(test.modify(testFirmware(t)))
+		if err == nil {
+			t.Errorf("%s: inconsistent header accepted", test.name)
+		}
+	}
+}
+
+func TestWriteFirmwareWrongRadio(t *testing.T) {
+	file := testFirmware(t)
+	copy(file[firmware.RadioOffset:], []byte{0x30, 0x03})
+
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.WriteFirmware(bytes.NewReader(file), dfu.Model("MD380"))
+	if _, ok := err.(*dfu.MismatchError); !ok {
+		t.Errorf("got error %v, want a *MismatchError", err)
+	}
+	if radio.InternalFlash(appBase, 1)[0] != 0xff {
+		t.Error("the radio was written")
+	}
+}
+
+// intelHex returns an Intel HEX file holding segments.
+func intelHex(segments []dfu.Segment) []byte {
+	var b bytes.Buffer
+	record := func(typ byte, address int, data []byte) {
+		rec := []byte{byte(len(data)), byte(address >> 8), byte(address), typ}
+		rec = append(rec, data...)
+		var sum byte
+		for _, c := range rec {
+			sum += c
+		}
+		rec = append(rec, -sum)
+		fmt.Fprintf(&b, ":%X\n", rec)
+	}
+
+	for _, seg := range segments {
+		for i := 0; i < len(seg.Data); i += 16 {
+			address := seg.Address + i
+			end := i + 16
+			if end > len(seg.Data) {
+				end = len(seg.Data)
+			}
+			record(4, 0, []byte{byte(address >> 24), byte(address >> 16)})
+			record(0, address&0xffff, seg.Data[i:end])
+		}
+	}
+	record(1, 0, nil)
+
+	return b.Bytes()
+}
+
+func TestWriteFirmwarePatch(t *testing.T) {
+	patch := bytes.Repeat([]byte{0x42}, 40)
+	other := bytes.Repeat([]byte{0x24}, 8)
+	file := intelHex([]dfu.Segment{
+		{Address: 0x08020010, Data: patch},
+		{Address: 0x08020100, Data: other},
+	})
+
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.WriteFirmware(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Repeat([]byte{0xff}, 0x110)
+	copy(want[0x10:], patch)
+	copy(want[0x100:], other)
+	if !bytes.Equal(radio.InternalFlash(0x08020000, len(want)), want) {
+		t.Error("the patch was not written where it belongs")
+	}
+}
+
+func TestWriteFirmwareBadVectorTable(t *testing.T) {
+	file := intelHex([]dfu.Segment{
+		{Address: appBase, Data: make([]byte, 16)},
+	})
+
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.WriteFirmware(bytes.NewReader(file))
+	if err == nil {
+		t.Error("image with an empty vector table accepted")
+	}
+}
+
+func TestWriteFirmwareBadLayout(t *testing.T) {
+	file := intelHex([]dfu.Segment{
+		{Address: 0x08020010, Data: bytes.Repeat([]byte{0x42}, 16)},
+	})
+
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	radio.SetInternalFlashLayout("@Internal Flash  /0x08000000/04*016Kx")
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.WriteFirmware(bytes.NewReader(file))
+	if err == nil {
+		t.Error("firmware written with an unparsable flash layout")
+	}
+	if radio.InternalFlash(0x08020010, 1)[0] != 0xff {
+		t.Error("the radio was written")
+	}
+}
+
+func TestWriteDfuSePolicy(t *testing.T) {
+	plain := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(plain[0:], 0x20020000)
+	binary.LittleEndian.PutUint32(plain[4:], appBase+0x101)
+	img := &dfu.DfuSeImage{
+		DeviceVersion: 0x0213,
+		ProductID:     0xdf11,
+		VendorID:      0x0483,
+		Targets: []dfu.DfuSeTarget{{
+			Elements: []dfu.Segment{{Address: appBase, Data: plain}},
+		}},
+	}
+
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The policy's error is returned as WriteFirmware returns it.
+	err = d.WriteDfuSe(img, dfu.Policy(&dfu.FirmwarePolicy{MinVersion: "3.0"}))
+	if _, ok := err.(*dfu.PolicyError); !ok {
+		t.Errorf("got error %v, want a *PolicyError", err)
+	}
+	if radio.InternalFlash(appBase, 1)[0] != 0xff {
+		t.Error("the radio was written")
+	}
+
+	err = d.WriteDfuSe(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(radio.InternalFlash(appBase, len(plain)), plain) {
+		t.Error("the image was not written")
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fleet programs several attached radios at once.
+package fleet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// Op is an operation performed by a job.
+type Op int
+
+const (
+	WriteCodeplug Op = iota // dfu.WriteCodeplugAtomic
+	WriteUsers              // dfu.WriteRawUsers
+	WriteFirmware           // dfu.WriteFirmware
+)
+
+func (op Op) String() string {
+	switch op {
+	case WriteCodeplug:
+		return "write codeplug"
+	case WriteUsers:
+		return "write users"
+	case WriteFirmware:
+		return "write firmware"
+	}
+
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Job is an operation on one radio.
+type Job struct {
+	Selector string // the radio, as accepted by dfu.Open
+	Op       Op
+	Data     []byte       // the codeplug, raw users image or firmware
+	Options  []dfu.Option // options for the write, where it takes any
+}
+
+// Result is the outcome of a job.
+type Result struct {
+	Job      *Job
+	Err      error  // nil if the job succeeded
+	SHA256   string // the hash of the data written, if the job succeeded
+	Started  time.Time
+	Finished time.Time
+
+	// Codeplug is what a WriteCodeplug job left the radio's codeplug
+	// holding, even if the job failed.
+	Codeplug dfu.CodeplugState
+}
+
+// ErrSkipped is the error of jobs not run because an earlier job for
+// the same radio failed.
+var ErrSkipped = errors.New("skipped after an earlier job for the radio failed")
+
+// Runner runs jobs on several radios concurrently.
+type Runner struct {
+	// Open opens a radio.  If nil, dfu.Open is used.
+	Open func(selector string, progressCallback func(progressCounter int) error) (*dfu.Dfu, error)
+
+	// ReopenTimeout is how long to keep trying to open a radio that
+	// is restarting after an earlier job.  If zero, 30 seconds is used.
+	ReopenTimeout time.Duration
+
+	// Progress, if not nil, is called as jobs progress, with the
+	// radio's selector, the job, the job's percentage complete and the
+	// percentage complete of all jobs.  Calls are not concurrent.
+	Progress func(selector string, job *Job, percent, overall int)
+
+	mu       sync.Mutex
+	jobs     int
+	progress map[*Job]int
+}
+
+const reopenInterval = time.Second
+
+// Run runs jobs and returns their results, in the same order.  The
+// jobs for each radio are run in order, by a goroutine for that radio.
+// The failure of a job does not affect jobs for other radios, but
+// later jobs for the same radio are skipped, with ErrSkipped.  If ctx
+// is canceled, running jobs are stopped and the remaining jobs fail
+// with ctx.Err().
+func (r *Runner) Run(ctx context.Context, jobs []*Job) []*Result {
+	results := make([]*Result, len(jobs))
+
+	bySelector := make(map[string][]int)
+	var selectors []string
+	for i, job := range jobs {
+		if bySelector[job.Selector] == nil {
+			selectors = append(selectors, job.Selector)
+		}
+		bySelector[job.Selector] = append(bySelector[job.Selector], i)
+	}
+
+	r.mu.Lock()
+	r.jobs = len(jobs)
+	r.progress = make(map[*Job]int)
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, selector := range selectors {
+		indexes := bySelector[selector]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var failed bool
+			for n, i := range indexes {
+				job := jobs[i]
+				result := &Result{
+					Job:     job,
+					Started: time.Now(),
+				}
+				switch {
+				case ctx.Err() != nil:
+					result.Err = ctx.Err()
+				case failed:
+					result.Err = ErrSkipped
+				default:
+					result.SHA256, result.Codeplug, result.Err = r.runJob(ctx, job, n > 0)
+				}
+				result.Finished = time.Now()
+				results[i] = result
+
+				if result.Err != nil {
+					failed = true
+				}
+				r.report(job, 100)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runJob runs job, returning the hash of the data written and, for a
+// WriteCodeplug job, the state of the radio's codeplug.  If reopen is
+// true, the radio may still be restarting after an earlier job.
+func (r *Runner) runJob(ctx context.Context, job *Job, reopen bool) (sha string, state dfu.CodeplugState, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s: panic: %v", job.Op, p)
+			if job.Op == WriteCodeplug {
+				state = dfu.CodeplugCorrupt
+			}
+		}
+	}()
+
+	progressCallback := func(progressCounter int) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.report(job, progressCounter*100/dfu.MaxProgress)
+		return nil
+	}
+
+	d, err := r.open(ctx, job.Selector, progressCallback, reopen)
+	if err != nil {
+		return "", dfu.CodeplugUnchanged, err
+	}
+	defer d.Close()
+
+	switch job.Op {
+	case WriteCodeplug:
+		state, err = d.WriteCodeplugAtomic(job.Data, job.Options...)
+	case WriteUsers:
+		err = d.WriteRawUsers(bytes.NewReader(job.Data), len(job.Data), job.Options...)
+	case WriteFirmware:
+		err = d.WriteFirmware(bytes.NewReader(job.Data), job.Options...)
+	default:
+		err = fmt.Errorf("unknown operation %s", job.Op)
+	}
+	if err != nil {
+		return "", state, err
+	}
+
+	sum := sha256.Sum256(job.Data)
+
+	return hex.EncodeToString(sum[:]), state, nil
+}
+
+func (r *Runner) open(ctx context.Context, selector string, progressCallback func(int) error, reopen bool) (*dfu.Dfu, error) {
+	open := r.Open
+	if open == nil {
+		open = dfu.Open
+	}
+
+	timeout := r.ReopenTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		d, err := open(selector, progressCallback)
+		if err == nil || !reopen || time.Now().After(deadline) {
+			return d, err
+		}
+
+		select {
+		case <-time.After(reopenInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// report records the progress of job and calls the Progress function.
+func (r *Runner) report(job *Job, percent int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if percent > 100 {
+		percent = 100
+	}
+	r.progress[job] = percent
+
+	if r.Progress == nil {
+		return
+	}
+
+	total := 0
+	for _, p := range r.progress {
+		total += p
+	}
+
+	r.Progress(job.Selector, job, percent, total/r.jobs)
+}
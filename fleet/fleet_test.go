@@ -0,0 +1,289 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package fleet_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/fleet"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+var codeplugSize = dfu.LookupProfile("MD380").CodeplugSize
+
+// testCodeplug returns a codeplug image filled from seed.
+func testCodeplug(seed byte) []byte {
+	data := make([]byte, codeplugSize)
+	for i := range data {
+		data[i] = seed + byte(i) + byte(i>>10)
+	}
+
+	return data
+}
+
+func sha(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// simFleet is a set of simulated MD380s, selected by path.
+type simFleet struct {
+	mu     sync.Mutex
+	radios map[string]*sim.Radio
+	opens  map[string]int
+
+	// fail, if not nil, is called before each radio is opened, with
+	// the number of earlier opens, and may fail the open.
+	fail func(path string, opens int) error
+}
+
+// newSimFleet returns a fleet of radios at paths "1-1", "1-2" and so on,
+// each with its own serial number and unique ID.
+func newSimFleet(n int) *simFleet {
+	f := &simFleet{
+		radios: make(map[string]*sim.Radio),
+		opens:  make(map[string]int),
+	}
+	for i := 1; i <= n; i++ {
+		radio := sim.New("MD380")
+		radio.SetSerial(fmt.Sprintf("SERIAL%d", i))
+		radio.SetUniqueID([]byte(fmt.Sprintf("unit-%07d", i)))
+		f.radios[fmt.Sprintf("1-%d", i)] = radio
+	}
+
+	return f
+}
+
+func (f *simFleet) Open(path string, progressCallback func(int) error) (*dfu.Dfu, error) {
+	f.mu.Lock()
+	radio := f.radios[path]
+	opens := f.opens[path]
+	f.opens[path]++
+	fail := f.fail
+	f.mu.Unlock()
+
+	if radio == nil {
+		return nil, fmt.Errorf("Open: no radio matches %q", path)
+	}
+	if fail != nil {
+		err := fail(path, opens)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dfu.NewWithTransport(radio, progressCallback)
+}
+
+func TestRunFailureIsolation(t *testing.T) {
+	f := newSimFleet(3)
+	users := []byte("1\n1,A,B,C,D,E,F\n")
+
+	var jobs []*fleet.Job
+	for i := 1; i <= 3; i++ {
+		codeplug := testCodeplug(byte(i))
+		if i == 2 {
+			codeplug = codeplug[:1024] // refused by the radio
+		}
+		selector := fmt.Sprintf("1-%d", i)
+		jobs = append(jobs,
+			&fleet.Job{Selector: selector, Op: fleet.WriteCodeplug, Data: codeplug},
+			&fleet.Job{Selector: selector, Op: fleet.WriteUsers, Data: users})
+	}
+
+	var overall int
+	r := &fleet.Runner{
+		Open: f.Open,
+		Progress: func(selector string, job *fleet.Job, percent, all int) {
+			overall = all
+		},
+	}
+	results := r.Run(context.Background(), jobs)
+
+	if len(results) != len(jobs) {
+		t.Fatalf("%d results for %d jobs", len(results), len(jobs))
+	}
+	for i, result := range results {
+		if result.Job != jobs[i] {
+			t.Errorf("result %d is for another job", i)
+		}
+	}
+
+	for _, i := range []int{0, 1, 4, 5} {
+		if results[i].Err != nil {
+			t.Errorf("job %d: %s", i, results[i].Err)
+		}
+		if results[i].SHA256 != sha(jobs[i].Data) {
+			t.Errorf("job %d: SHA-256 is %q", i, results[i].SHA256)
+		}
+	}
+	if _, ok := results[2].Err.(*dfu.MismatchError); !ok {
+		t.Errorf("short codeplug: got error %v, want a *MismatchError", results[2].Err)
+	}
+	if results[3].Err != fleet.ErrSkipped || results[3].SHA256 != "" {
+		t.Errorf("users after failed codeplug: got error %v, want ErrSkipped", results[3].Err)
+	}
+
+	for path, seed := range map[string]byte{"1-1": 1, "1-3": 3} {
+		if !bytes.Equal(f.radios[path].Flash(0, codeplugSize), testCodeplug(seed)) {
+			t.Errorf("radio %s does not hold its codeplug", path)
+		}
+	}
+	if f.radios["1-2"].Flash(0, 1)[0] != 0xff {
+		t.Error("the failing radio was written")
+	}
+	if overall != 100 {
+		t.Errorf("overall progress ended at %d%%", overall)
+	}
+}
+
+func TestRunReopen(t *testing.T) {
+	f := newSimFleet(1)
+	restarting := errors.New("radio is restarting")
+
+	// The radio is not back at once after the first job.
+	f.fail = func(path string, opens int) error {
+		if opens == 1 {
+			return restarting
+		}
+		return nil
+	}
+
+	jobs := []*fleet.Job{
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(1)},
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(2)},
+	}
+	r := &fleet.Runner{Open: f.Open}
+	for i, result := range r.Run(context.Background(), jobs) {
+		if result.Err != nil {
+			t.Errorf("job %d: %s", i, result.Err)
+		}
+	}
+	if f.opens["1-1"] != 3 {
+		t.Errorf("radio opened %d times, want 3", f.opens["1-1"])
+	}
+	if !bytes.Equal(f.radios["1-1"].Flash(0, codeplugSize), testCodeplug(2)) {
+		t.Error("the radio does not hold the second codeplug")
+	}
+}
+
+func TestRunFirstOpenNotRetried(t *testing.T) {
+	f := newSimFleet(1)
+	f.fail = func(path string, opens int) error {
+		return errors.New("radio is not attached")
+	}
+
+	jobs := []*fleet.Job{
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(1)},
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(2)},
+	}
+	r := &fleet.Runner{Open: f.Open}
+	results := r.Run(context.Background(), jobs)
+
+	if results[0].Err == nil || results[1].Err != fleet.ErrSkipped {
+		t.Errorf("got errors %v and %v", results[0].Err, results[1].Err)
+	}
+	if f.opens["1-1"] != 1 {
+		t.Errorf("radio opened %d times, want 1", f.opens["1-1"])
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	f := newSimFleet(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := []*fleet.Job{
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(1)},
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(2)},
+	}
+
+	// Cancel once the first job is under way.
+	r := &fleet.Runner{
+		Open: f.Open,
+		Progress: func(selector string, job *fleet.Job, percent, overall int) {
+			if job == jobs[0] && percent > 0 {
+				cancel()
+			}
+		},
+	}
+	results := r.Run(ctx, jobs)
+
+	if results[0].Err == nil {
+		t.Error("cancelled job succeeded")
+	}
+	if results[1].Err != context.Canceled {
+		t.Errorf("job after cancel: got error %v, want %v", results[1].Err, context.Canceled)
+	}
+	if f.opens["1-1"] != 1 {
+		t.Errorf("radio opened %d times, want 1", f.opens["1-1"])
+	}
+}
+
+func TestRunCancelCodeplugWrite(t *testing.T) {
+	f := newSimFleet(1)
+	radio := f.radios["1-1"]
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := []*fleet.Job{
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(1)},
+		{Selector: "1-1", Op: fleet.WriteCodeplug, Data: testCodeplug(2)},
+	}
+
+	// Cancel once the second job has begun erasing the radio's codeplug.
+	r := &fleet.Runner{
+		Open: f.Open,
+		Progress: func(selector string, job *fleet.Job, percent, overall int) {
+			if job == jobs[1] && !bytes.Equal(radio.Flash(0, 1024), jobs[0].Data[:1024]) {
+				cancel()
+			}
+		},
+	}
+	results := r.Run(ctx, jobs)
+
+	if results[0].Err != nil || results[0].Codeplug != dfu.CodeplugWritten {
+		t.Errorf("first job: got error %v and codeplug %s", results[0].Err, results[0].Codeplug)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("the second job was not cancelled while writing")
+	}
+	if results[1].Err == nil || results[1].SHA256 != "" {
+		t.Errorf("cancelled job: got error %v and SHA-256 %q", results[1].Err, results[1].SHA256)
+	}
+	if results[1].Codeplug != dfu.CodeplugRestored {
+		t.Errorf("cancelled job: codeplug %s, want %s", results[1].Codeplug, dfu.CodeplugRestored)
+	}
+	if !bytes.Equal(radio.Flash(0, codeplugSize), testCodeplug(1)) {
+		t.Error("the radio does not hold the first codeplug")
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package fleet
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// Manifest describes a fleet rollout.  It is read from JSON such as:
+//
+//	{
+//		"codeplug": "base.bin",
+//		"users": "users.bin",
+//		"radios": [
+//			{"uniqueID": "uid:...", "radioID": 3100001, "radioName": "Unit 1"},
+//			{"serial": "...", "radioID": 3100002, "radioName": "Unit 2",
+//			 "codeplug": "base-uv.bin"}
+//		]
+//	}
+//
+// File names are relative to the manifest's directory.  The codeplug
+// files are raw codeplug images, and the users files are raw users
+// images in the format of the radios' models.
+type Manifest struct {
+	Codeplug string   `json:"codeplug"`        // the base codeplug
+	Users    string   `json:"users,omitempty"` // the users database, if any
+	Radios   []*Radio `json:"radios"`
+
+	dir string
+}
+
+// Radio is a radio in a manifest, identified by its unique ID, as
+// returned by dfu.UniqueID, or its USB serial number.
+type Radio struct {
+	UniqueID  string `json:"uniqueID,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	Codeplug  string `json:"codeplug,omitempty"` // overrides the base codeplug
+	Users     string `json:"users,omitempty"`    // overrides the users database
+	RadioID   int    `json:"radioID,omitempty"`
+	RadioName string `json:"radioName,omitempty"`
+}
+
+func (r *Radio) String() string {
+	if r.UniqueID != "" {
+		return r.UniqueID
+	}
+	return "serial " + r.Serial
+}
+
+// ReadManifest reads a manifest file.
+func ReadManifest(filename string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	m.dir = filepath.Dir(filename)
+
+	for i, r := range m.Radios {
+		if r.UniqueID == "" && r.Serial == "" {
+			return nil, fmt.Errorf("%s: radio %d has no uniqueID or serial", filename, i+1)
+		}
+	}
+
+	return m, nil
+}
+
+// Report records the outcome of a rollout.
+type Report struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Radios   []*RadioReport `json:"radios"`
+}
+
+// RadioReport records what was written to a radio.
+type RadioReport struct {
+	UniqueID       string `json:"uniqueID,omitempty"`
+	Serial         string `json:"serial,omitempty"`
+	Path           string `json:"path,omitempty"`
+	Model          string `json:"model,omitempty"`
+	RadioID        int    `json:"radioID,omitempty"`
+	RadioName      string `json:"radioName,omitempty"`
+	CodeplugSHA256 string `json:"codeplugSHA256,omitempty"`
+	UsersSHA256    string `json:"usersSHA256,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Bytes returns the report as JSON.
+func (report *Report) Bytes() []byte {
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		panic(err) // cannot happen, a Report contains no unmarshalable types
+	}
+
+	return append(data, '\n')
+}
+
+// Sign returns signer's detached signature of report.Bytes(), which may
+// be checked with dfu.KeyRing.Verify.
+func (report *Report) Sign(signer string, key ed25519.PrivateKey) *dfu.Signature {
+	return dfu.Sign(report.Bytes(), signer, key)
+}
+
+// Failed returns the number of radios that were not fully written.
+func (report *Report) Failed() int {
+	n := 0
+	for _, r := range report.Radios {
+		if r.Error != "" {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Executor carries out manifests.
+type Executor struct {
+	// Runner runs the jobs.  Its Open function is also used to
+	// identify the attached radios.
+	Runner Runner
+
+	// List lists the attached radios.  If nil, dfu.List is used.
+	List func() ([]*dfu.DeviceInfo, error)
+}
+
+// attached is an attached radio.
+type attached struct {
+	info     *dfu.DeviceInfo
+	uniqueID string
+	profile  *dfu.Profile
+}
+
+// Execute writes each radio in m its personalized codeplug and its
+// users database, if any.  Radios that are not attached, and those
+// that fail, are recorded in the report and do not stop the others.
+// An error is returned only if nothing could be attempted.
+func (e *Executor) Execute(ctx context.Context, m *Manifest) (*Report, error) {
+	report := &Report{Started: time.Now()}
+
+	radios, err := e.attached()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	readFile := func(name string) ([]byte, error) {
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+		data, err := ioutil.ReadFile(filepath.Join(m.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+		return data, nil
+	}
+
+	var jobs []*Job
+	jobReports := make(map[*Job]*RadioReport)
+	for _, r := range m.Radios {
+		rr := &RadioReport{
+			UniqueID:  r.UniqueID,
+			Serial:    r.Serial,
+			RadioID:   r.RadioID,
+			RadioName: r.RadioName,
+		}
+		report.Radios = append(report.Radios, rr)
+
+		codeplugJob, usersJob, err := e.prepare(m, r, radios, rr, readFile)
+		if err != nil {
+			rr.Error = err.Error()
+			continue
+		}
+
+		jobs = append(jobs, codeplugJob)
+		jobReports[codeplugJob] = rr
+		if usersJob != nil {
+			jobs = append(jobs, usersJob)
+			jobReports[usersJob] = rr
+		}
+	}
+
+	for _, result := range e.Runner.Run(ctx, jobs) {
+		rr := jobReports[result.Job]
+		switch {
+		case result.Err != nil && rr.Error == "":
+			rr.Error = fmt.Sprintf("%s: %s", result.Job.Op, result.Err.Error())
+		case result.Err != nil:
+		case result.Job.Op == WriteCodeplug:
+			rr.CodeplugSHA256 = result.SHA256
+		case result.Job.Op == WriteUsers:
+			rr.UsersSHA256 = result.SHA256
+		}
+	}
+
+	report.Finished = time.Now()
+
+	return report, nil
+}
+
+// prepare returns the jobs for r, filling in rr's identity.
+func (e *Executor) prepare(m *Manifest, r *Radio, radios []*attached, rr *RadioReport, readFile func(string) ([]byte, error)) (*Job, *Job, error) {
+	var radio *attached
+	for _, a := range radios {
+		if (r.UniqueID != "" && a.uniqueID == r.UniqueID) ||
+			(r.UniqueID == "" && a.info.Serial == r.Serial) {
+			if radio != nil {
+				return nil, nil, errors.New("more than one attached radio matches")
+			}
+			radio = a
+		}
+	}
+	if radio == nil {
+		return nil, nil, errors.New("not attached")
+	}
+	rr.UniqueID = radio.uniqueID
+	rr.Serial = radio.info.Serial
+	rr.Path = radio.info.Path
+	if radio.profile == nil {
+		return nil, nil, errors.New("radio model is unknown")
+	}
+	rr.Model = radio.profile.Name
+
+	name := r.Codeplug
+	if name == "" {
+		name = m.Codeplug
+	}
+	if name == "" {
+		return nil, nil, errors.New("no codeplug")
+	}
+	base, err := readFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	codeplug := append([]byte(nil), base...)
+	if r.RadioID != 0 {
+		err = radio.profile.SetRadioID(codeplug, r.RadioID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.RadioName != "" {
+		err = radio.profile.SetRadioName(codeplug, r.RadioName)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	codeplugJob := &Job{
+		Selector: radio.info.Path,
+		Op:       WriteCodeplug,
+		Data:     codeplug,
+	}
+
+	name = r.Users
+	if name == "" {
+		name = m.Users
+	}
+	if name == "" {
+		return codeplugJob, nil, nil
+	}
+	users, err := readFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usersJob := &Job{
+		Selector: radio.info.Path,
+		Op:       WriteUsers,
+		Data:     users,
+	}
+
+	return codeplugJob, usersJob, nil
+}
+
+// attached returns the attached radios, with their unique IDs and
+// profiles where they can be read.
+func (e *Executor) attached() ([]*attached, error) {
+	list := e.List
+	if list == nil {
+		list = dfu.List
+	}
+	open := e.Runner.Open
+	if open == nil {
+		open = dfu.Open
+	}
+
+	infos, err := list()
+	if err != nil {
+		return nil, err
+	}
+
+	var radios []*attached
+	for _, info := range infos {
+		a := &attached{info: info}
+		radios = append(radios, a)
+
+		d, err := open(info.Path, nil)
+		if err != nil {
+			continue
+		}
+		a.uniqueID, _ = d.UniqueID()
+		a.profile, _ = d.Profile()
+		d.Close()
+	}
+
+	return radios, nil
+}
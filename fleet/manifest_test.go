@@ -0,0 +1,181 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package fleet_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/fleet"
+)
+
+// writeFiles writes files, given as name, contents pairs, to a new
+// directory, and returns the directory.
+func writeFiles(t *testing.T, files ...string) string {
+	dir, err := ioutil.TempDir("", "fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(files); i += 2 {
+		err = ioutil.WriteFile(filepath.Join(dir, files[i]), []byte(files[i+1]), 0644)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestExecute(t *testing.T) {
+	base := testCodeplug(1)
+	other := testCodeplug(2)
+	users := "1\n1,A,B,C,D,E,F\n"
+	uid1 := "uid:" + hex.EncodeToString([]byte("unit-0000001"))
+
+	dir := writeFiles(t,
+		"manifest.json", `{
+			"codeplug": "base.bin",
+			"users": "users.bin",
+			"radios": [
+				{"uniqueID": "`+uid1+`", "radioID": 3100001, "radioName": "Unit 1"},
+				{"serial": "SERIAL2", "radioID": 3100002, "codeplug": "other.bin"},
+				{"serial": "SERIAL3", "radioID": 3100003},
+				{"serial": "MISSING", "radioID": 3100004}
+			]
+		}`,
+		"base.bin", string(base),
+		"other.bin", string(other),
+		"users.bin", users)
+	defer os.RemoveAll(dir)
+
+	m, err := fleet.ReadManifest(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The third radio is identified, then fails to open for its job.
+	f := newSimFleet(3)
+	f.fail = func(path string, opens int) error {
+		if path == "1-3" && opens > 0 {
+			return errors.New("radio is gone")
+		}
+		return nil
+	}
+	e := &fleet.Executor{
+		Runner: fleet.Runner{Open: f.Open},
+		List: func() ([]*dfu.DeviceInfo, error) {
+			var infos []*dfu.DeviceInfo
+			for _, path := range []string{"1-1", "1-2", "1-3"} {
+				infos = append(infos, &dfu.DeviceInfo{
+					Path:   path,
+					Serial: "SERIAL" + path[2:],
+				})
+			}
+			return infos, nil
+		},
+	}
+
+	report, err := e.Execute(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Radios) != 4 {
+		t.Fatalf("report has %d radios, want 4", len(report.Radios))
+	}
+	if report.Failed() != 2 {
+		t.Errorf("%d radios failed, want 2", report.Failed())
+	}
+
+	p := dfu.LookupProfile("MD380")
+	want1 := append([]byte(nil), base...)
+	p.SetRadioID(want1, 3100001)
+	p.SetRadioName(want1, "Unit 1")
+	want2 := append([]byte(nil), other...)
+	p.SetRadioID(want2, 3100002)
+
+	for i, want := range [][]byte{want1, want2} {
+		rr := report.Radios[i]
+		radio := f.radios[rr.Path]
+		if rr.Error != "" {
+			t.Errorf("radio %d: %s", i+1, rr.Error)
+			continue
+		}
+		if radio == nil || rr.Model != "MD380" || rr.UniqueID == "" || rr.Serial == "" {
+			t.Errorf("radio %d: reported as %+v", i+1, rr)
+			continue
+		}
+		if !bytes.Equal(radio.Flash(0, codeplugSize), want) {
+			t.Errorf("radio %d does not hold its personalized codeplug", i+1)
+		}
+		if rr.CodeplugSHA256 != sha(want) {
+			t.Errorf("radio %d: codeplug SHA-256 is %q", i+1, rr.CodeplugSHA256)
+		}
+		if rr.UsersSHA256 != sha([]byte(users)) {
+			t.Errorf("radio %d: users SHA-256 is %q", i+1, rr.UsersSHA256)
+		}
+	}
+	if report.Radios[0].UniqueID != uid1 || report.Radios[1].Path != "1-2" {
+		t.Errorf("radios matched as %+v and %+v", report.Radios[0], report.Radios[1])
+	}
+
+	failed := report.Radios[2]
+	if !strings.HasPrefix(failed.Error, "write codeplug: ") || failed.CodeplugSHA256 != "" || failed.UsersSHA256 != "" {
+		t.Errorf("failed radio reported as %+v", failed)
+	}
+	if f.radios["1-3"].Flash(0, 1)[0] != 0xff {
+		t.Error("the failed radio was written")
+	}
+	if report.Radios[3].Error != "not attached" {
+		t.Errorf("missing radio reported as %+v", report.Radios[3])
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{"no identity", `{"codeplug": "base.bin", "radios": [{"radioID": 1}]}`},
+		{"bad JSON", `{"codeplug": `},
+	}
+
+	for _, test := range tests {
+		dir := writeFiles(t, "manifest.json", test.manifest)
+		_, err := fleet.ReadManifest(filepath.Join(dir, "manifest.json"))
+		os.RemoveAll(dir)
+		if err == nil {
+			t.Errorf("%s: manifest accepted", test.name)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/dalefarnsworth-dmr/dfu
 
-go 1.12
+go 1.13
 
 require (
 	github.com/dalefarnsworth-dmr/debug v1.0.19 // indirect
@@ -0,0 +1,241 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseIntelHex parses an Intel HEX file into a sparse memory image,
+// returned as non-overlapping segments in address order.  The file
+// must end with an end of file record, so that a truncated file is
+// refused.
+func ParseIntelHex(data []byte) ([]Segment, error) {
+	var segments []Segment
+	base := 0
+	sawEOF := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if sawEOF {
+			return nil, fmt.Errorf("ParseIntelHex: line %d: data after end of file record", lineNumber)
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("ParseIntelHex: line %d: missing ':'", lineNumber)
+		}
+
+		record, err := hex.DecodeString(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("ParseIntelHex: line %d: %s", lineNumber, err.Error())
+		}
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, fmt.Errorf("ParseIntelHex: line %d: bad record length", lineNumber)
+		}
+
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("ParseIntelHex: line %d: bad checksum", lineNumber)
+		}
+
+		offset := int(record[1])<<8 | int(record[2])
+		payload := record[4 : len(record)-1]
+
+		switch record[3] {
+		case 0x00: // data
+			segments = appendSegment(segments, base+offset, payload)
+
+		case 0x01: // end of file
+			sawEOF = true
+
+		case 0x02: // extended segment address
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("ParseIntelHex: line %d: bad extended segment address", lineNumber)
+			}
+			base = (int(payload[0])<<8 | int(payload[1])) << 4
+
+		case 0x04: // extended linear address
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("ParseIntelHex: line %d: bad extended linear address", lineNumber)
+			}
+			base = (int(payload[0])<<8 | int(payload[1])) << 16
+
+		case 0x03, 0x05: // start address, not needed for flashing
+
+		default:
+			return nil, fmt.Errorf("ParseIntelHex: line %d: unknown record type %02x", lineNumber, record[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, wrapError("ParseIntelHex", err)
+	}
+	if !sawEOF {
+		return nil, errors.New("ParseIntelHex: missing end of file record")
+	}
+
+	segments, err := mergeSegments(segments)
+	if err != nil {
+		return nil, wrapError("ParseIntelHex", err)
+	}
+
+	return segments, nil
+}
+
+// ParseSRecord parses a Motorola S-record file into a sparse memory
+// image, returned as non-overlapping segments in address order.  As
+// with ParseIntelHex, the file must end with a termination record,
+// S7, S8 or S9.
+func ParseSRecord(data []byte) ([]Segment, error) {
+	var segments []Segment
+	sawEnd := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if sawEnd {
+			return nil, fmt.Errorf("ParseSRecord: line %d: data after termination record", lineNumber)
+		}
+		if len(line) < 4 || line[0] != 'S' {
+			return nil, fmt.Errorf("ParseSRecord: line %d: missing 'S'", lineNumber)
+		}
+
+		recordType := line[1]
+		record, err := hex.DecodeString(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("ParseSRecord: line %d: %s", lineNumber, err.Error())
+		}
+		if len(record) < 1 || len(record) != int(record[0])+1 {
+			return nil, fmt.Errorf("ParseSRecord: line %d: bad record length", lineNumber)
+		}
+
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0xff {
+			return nil, fmt.Errorf("ParseSRecord: line %d: bad checksum", lineNumber)
+		}
+
+		var addrSize int
+		switch recordType {
+		case '0', '1', '5', '9':
+			addrSize = 2
+		case '2', '6', '8':
+			addrSize = 3
+		case '3', '7':
+			addrSize = 4
+		default:
+			return nil, fmt.Errorf("ParseSRecord: line %d: unknown record type S%c", lineNumber, recordType)
+		}
+		if len(record) < 1+addrSize+1 {
+			return nil, fmt.Errorf("ParseSRecord: line %d: record too short", lineNumber)
+		}
+
+		address := 0
+		for _, b := range record[1 : 1+addrSize] {
+			address = address<<8 | int(b)
+		}
+		payload := record[1+addrSize : len(record)-1]
+
+		switch recordType {
+		case '1', '2', '3': // data
+			segments = appendSegment(segments, address, payload)
+
+		case '7', '8', '9': // termination
+			sawEnd = true
+
+		case '0', '5', '6': // header and record counts
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, wrapError("ParseSRecord", err)
+	}
+	if !sawEnd {
+		return nil, errors.New("ParseSRecord: missing termination record")
+	}
+
+	segments, err := mergeSegments(segments)
+	if err != nil {
+		return nil, wrapError("ParseSRecord", err)
+	}
+
+	return segments, nil
+}
+
+// appendSegment appends data at address to segments, extending the
+// last segment if data follows on from it.
+func appendSegment(segments []Segment, address int, data []byte) []Segment {
+	last := len(segments) - 1
+	if last >= 0 && segments[last].Address+len(segments[last].Data) == address {
+		segments[last].Data = append(segments[last].Data, data...)
+		return segments
+	}
+
+	return append(segments, Segment{address, append([]byte(nil), data...)})
+}
+
+// mergeSegments sorts segments by address and joins adjacent segments.
+// Overlapping segments are an error.
+func mergeSegments(segments []Segment) ([]Segment, error) {
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Address < segments[j].Address
+	})
+
+	var merged []Segment
+	for _, seg := range segments {
+		if len(seg.Data) == 0 {
+			continue
+		}
+
+		last := len(merged) - 1
+		if last >= 0 {
+			end := merged[last].Address + len(merged[last].Data)
+			if seg.Address < end {
+				return nil, fmt.Errorf("data overlaps at 0x%08x", seg.Address)
+			}
+			if seg.Address == end {
+				merged[last].Data = append(merged[last].Data, seg.Data...)
+				continue
+			}
+		}
+		merged = append(merged, seg)
+	}
+
+	return merged, nil
+}
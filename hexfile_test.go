@@ -0,0 +1,175 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// lines joins records into a file.
+func lines(records ...string) []byte {
+	return []byte(strings.Join(records, "\n") + "\n")
+}
+
+// checkSegments fails the test unless got is want.
+func checkSegments(t *testing.T, name string, got, want []dfu.Segment) {
+	if len(got) != len(want) {
+		t.Errorf("%s: %d segments, want %d", name, len(got), len(want))
+		return
+	}
+	for i := range want {
+		if got[i].Address != want[i].Address || !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("%s: segment %d is % x at 0x%08x, want % x at 0x%08x", name, i,
+				got[i].Data, got[i].Address, want[i].Data, want[i].Address)
+		}
+	}
+}
+
+func TestParseIntelHex(t *testing.T) {
+	file := lines(
+		":020000040800F2",     // extended linear address 0x0800
+		":02C00400010237",     // data at 0xc004
+		":04C00000DEADBEEF04", // data at 0xc000, joining the record above
+		":02FFFE00AABB9C",     // data at 0xfffe
+		":020000040801F1",     // extended linear address 0x0801
+		":01000000CC33",       // continuing across the 64K boundary
+		":020000021000EC",     // extended segment address 0x1000
+		":01001000559A",       // data at 0x10010
+		":040000050800C1012D", // start linear address, ignored
+		":00000001FF",         // end of file
+	)
+
+	segments, err := dfu.ParseIntelHex(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSegments(t, "Intel HEX", segments, []dfu.Segment{
+		{Address: 0x00010010, Data: []byte{0x55}},
+		{Address: 0x0800c000, Data: []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02}},
+		{Address: 0x0800fffe, Data: []byte{0xaa, 0xbb, 0xcc}},
+	})
+}
+
+func TestParseIntelHexErrors(t *testing.T) {
+	data := ":04C00000DEADBEEF04"
+	eof := ":00000001FF"
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"checksum", lines(":04C00000DEADBEEF05", eof)},
+		{"missing end of file", lines(data)},
+		{"data after end of file", lines(eof, data)},
+		{"missing colon", lines(data[1:], eof)},
+		{"not hex", lines(":04C00000DEADBEEG04", eof)},
+		{"length", lines(":05C00000DEADBEEF03", eof)},
+		{"unknown record type", lines(":00000006FA", eof)},
+		{"extended linear address length", lines(":0100000408F3", eof)},
+		{"overlap", lines(data, ":01C00200112C", eof)},
+	}
+
+	for _, test := range tests {
+		_, err := dfu.ParseIntelHex(test.file)
+		if err == nil {
+			t.Errorf("%s: bad file accepted", test.name)
+		}
+	}
+}
+
+func TestParseSRecord(t *testing.T) {
+	file := lines(
+		"S0060000686472BB",   // header
+		"S10510000102E7",     // S1, 16-bit address 0x1000
+		"S2060810000304DA",   // S2, 24-bit address 0x081000
+		"S3070800C002BEEF81", // S3, 32-bit address 0x0800c002
+		"S3070800C000DEADA5", // joining the record above
+		"S5030003F9",         // record count
+		"S7050800C00032",     // termination with start address
+	)
+
+	segments, err := dfu.ParseSRecord(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSegments(t, "S-record", segments, []dfu.Segment{
+		{Address: 0x00001000, Data: []byte{0x01, 0x02}},
+		{Address: 0x00081000, Data: []byte{0x03, 0x04}},
+		{Address: 0x0800c000, Data: []byte{0xde, 0xad, 0xbe, 0xef}},
+	})
+}
+
+func TestParseSRecordErrors(t *testing.T) {
+	data := "S3070800C000DEADA5"
+	end := "S9030000FC"
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"checksum", lines("S3070800C000DEADA6", end)},
+		{"missing termination", lines(data)},
+		{"data after termination", lines(end, data)},
+		{"missing S", lines(data[1:], end)},
+		{"length", lines("S3080800C000DEADA4", end)},
+		{"unknown record type", lines("S4030000FC", end)},
+		{"overlap", lines(data, data, end)},
+	}
+
+	for _, test := range tests {
+		_, err := dfu.ParseSRecord(test.file)
+		if err == nil {
+			t.Errorf("%s: bad file accepted", test.name)
+		}
+	}
+}
+
+func TestParseFirmwareHexFormats(t *testing.T) {
+	tests := []struct {
+		file []byte
+		kind dfu.FirmwareKind
+	}{
+		{lines(":020000040800F2", ":04C00000DEADBEEF04", ":00000001FF"), dfu.FirmwareIntelHex},
+		{lines("S3070800C000DEADA5", "S3070800C002BEEF81", "S9030000FC"), dfu.FirmwareSRecord},
+	}
+
+	for _, test := range tests {
+		fw, err := dfu.ParseFirmware(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fw.Kind != test.kind {
+			t.Errorf("kind is %s, want %s", fw.Kind, test.kind)
+		}
+		checkSegments(t, test.kind.String(), fw.Segments, []dfu.Segment{
+			{Address: 0x0800c000, Data: []byte{0xde, 0xad, 0xbe, 0xef}},
+		})
+	}
+}
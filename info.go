@@ -0,0 +1,237 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// The bootloader's manufacturer string, which distinguishes it from
+// the radio's application firmware.
+const bootloaderManufacturer = "AnyRoad Technology"
+
+// usbSerialNumberIndex is the usual index of the USB serial number
+// string descriptor.
+const usbSerialNumberIndex = 3
+
+// RadioInfo describes the attached radio.  Fields the radio cannot
+// report in its current mode are left empty.
+type RadioInfo struct {
+	Manufacturer string
+	Bootloader   bool     // the radio is in bootloader mode
+	Model        string   // the model reported by the radio
+	Profile      *Profile // the profile for Model, if known
+	SPIFlash     string   // the SPI flash part
+	UniqueID     string   // see UniqueID
+}
+
+// RadioInfo returns a description of the attached radio.
+func (dfu *Dfu) RadioInfo() (*RadioInfo, error) {
+	defer dfu.operation("RadioInfo")()
+
+	mfg, err := dfu.init()
+	if err != nil {
+		return nil, wrapError("RadioInfo", err)
+	}
+
+	info := &RadioInfo{
+		Manufacturer: mfg,
+		Bootloader:   mfg == bootloaderManufacturer,
+	}
+
+	if !info.Bootloader {
+		model, err := dfu.readModel()
+		if err == nil {
+			info.Model = model
+			info.Profile = LookupProfile(model)
+			if info.Profile != nil {
+				dfu.profile = info.Profile
+			}
+		}
+
+		id, err := dfu.spiFlashID()
+		if err == nil {
+			info.SPIFlash = id
+		}
+		dfu.enterDfuMode()
+	}
+
+	// A radio that cannot be identified is still described.
+	info.UniqueID, _ = dfu.UniqueID()
+
+	return info, nil
+}
+
+// The prefixes of the two forms of UniqueID.
+const (
+	uniqueIDPrefix    = "uid:"
+	fingerprintPrefix = "fp:"
+)
+
+// UniqueID returns a stable identifier for the attached radio.  Where
+// the MCU's 96-bit unique device ID can be read, it is "uid:" followed
+// by that ID in hex, and is the same in bootloader and application
+// mode.  In bootloader mode it is read from the system memory, where
+// the bootloader permits it.  In application mode it is read as
+// md380_tool.py's peek reads memory, which only firmware patched by
+// md380tools supports.
+//
+// With other firmware, UniqueID is instead "fp:" followed by a SHA-256
+// fingerprint of the USB serial number.  The firmware offers no way to
+// read the SPI flash's own unique ID, and the JEDEC ID is the same for
+// every radio of a model, so the fingerprint is only as unique as the
+// serial number, and radios whose firmware reports the same serial
+// collide.  The fingerprint is only available in application mode and
+// differs from the "uid:" form, so an inventory of radios with stock
+// firmware should record them in application mode.
+func (dfu *Dfu) UniqueID() (string, error) {
+	defer dfu.operation("UniqueID")()
+
+	if dfu.uniqueID != "" {
+		return dfu.uniqueID, nil
+	}
+
+	id, err := dfu.readUniqueID()
+	if err != nil {
+		return "", err
+	}
+	dfu.uniqueID = id
+
+	return id, nil
+}
+
+func (dfu *Dfu) readUniqueID() (string, error) {
+	mfg, err := dfu.init()
+	if err != nil {
+		return "", wrapError("UniqueID", err)
+	}
+
+	if mfg != bootloaderManufacturer {
+		uid, err := dfu.peekUniqueID()
+		if err != nil {
+			dfu.debug("unique device ID not read, using a fingerprint", "err", err.Error())
+			return dfu.fingerprint()
+		}
+		return uniqueIDPrefix + hex.EncodeToString(uid), nil
+	}
+
+	uid, err := dfu.ReadUniqueDeviceID()
+	if err != nil {
+		if e, ok := err.(*ReadProtectedError); ok {
+			e.Op = "UniqueID"
+			return "", e
+		}
+		return "", wrapError("UniqueID", err)
+	}
+
+	if isErased(uid) {
+		return "", errors.New("UniqueID: radio reported no unique device ID")
+	}
+
+	return uniqueIDPrefix + hex.EncodeToString(uid), nil
+}
+
+// peekUniqueID reads the MCU's unique device ID in application mode.
+// Firmware that does not support peeking answers with the same data
+// whatever the address, so the ID is only trusted if it differs from
+// the start of the internal flash, which holds the vector table.
+func (dfu *Dfu) peekUniqueID() ([]byte, error) {
+	uid, err := dfu.peekMemory(uniqueIDAddress, uniqueIDSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if isErased(uid) {
+		return nil, errors.New("radio reported no unique device ID")
+	}
+
+	other, err := dfu.peekMemory(flashBase, uniqueIDSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(uid, other) {
+		return nil, errors.New("radio's firmware does not support reading memory")
+	}
+
+	return uid, nil
+}
+
+// fingerprint returns the "fp:" form of UniqueID, in application mode.
+func (dfu *Dfu) fingerprint() (string, error) {
+	serial, _ := dfu.stDfu.GetStringDescriptor(usbSerialNumberIndex)
+	if serial == "" {
+		return "", errors.New("UniqueID: radio reported no serial number")
+	}
+
+	return serialFingerprint(serial), nil
+}
+
+// serialFingerprint returns the "fp:" form of UniqueID for a radio
+// with USB serial number serial.
+func serialFingerprint(serial string) string {
+	sum := sha256.Sum256([]byte(serial))
+
+	return fingerprintPrefix + hex.EncodeToString(sum[:])
+}
+
+// isErased reports whether data is all 0x00 or all 0xff bytes, as
+// firmware returns in place of memory it does not read.
+func isErased(data []byte) bool {
+	for _, b := range data {
+		if b != data[0] {
+			return false
+		}
+	}
+
+	return len(data) == 0 || data[0] == 0x00 || data[0] == 0xff
+}
+
+// peekMemory reads size bytes of MCU memory at address in application
+// mode.  Firmware patched by md380tools answers an upload to the SPI
+// flash block, after the address pointer is set, with the memory at
+// that address.
+func (dfu *Dfu) peekMemory(address, size int) ([]byte, error) {
+	err := dfu.setAddress(address)
+	if err != nil {
+		return nil, wrapError("peekMemory", err)
+	}
+
+	data := make([]byte, size)
+	err = dfu.stDfu.Upload(spiBlock, data)
+	if err != nil {
+		dfu.enterDfuMode()
+		return nil, wrapError("peekMemory", err)
+	}
+
+	err = dfu.enterDfuMode()
+	if err != nil {
+		return nil, wrapError("peekMemory", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// uniqueID returns the UniqueID of radio.
+func uniqueID(t *testing.T, radio *sim.Radio) string {
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	id, err := d.UniqueID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestUniqueID(t *testing.T) {
+	radio := sim.New("MD380")
+	radio.SetUniqueID([]byte("unit-0000001"))
+	other := sim.New("MD380")
+	other.SetUniqueID([]byte("unit-0000002"))
+
+	app := uniqueID(t, radio)
+	if app != "uid:756e69742d30303030303031" {
+		t.Errorf("application mode ID is %s", app)
+	}
+	if uniqueID(t, other) == app {
+		t.Error("radios with the same serial number have the same ID")
+	}
+
+	radio.SetBootloader(true)
+	if id := uniqueID(t, radio); id != app {
+		t.Errorf("bootloader mode ID %s differs from application mode ID %s", id, app)
+	}
+}
+
+func TestUniqueIDFingerprint(t *testing.T) {
+	radio := sim.New("MD380")
+	radio.SetStockFirmware(true)
+
+	// Stock firmware answers a peek with SPI flash data, which is
+	// neither erased nor unique to the radio.
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.WriteSPIFlash(bytes.NewReader([]byte("not a unique device ID")), 22)
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uniqueID(t, radio)
+	if !strings.HasPrefix(id, "fp:") {
+		t.Fatalf("stock firmware ID is %s, want a fingerprint", id)
+	}
+	if again := uniqueID(t, radio); again != id {
+		t.Errorf("fingerprint changed from %s to %s", id, again)
+	}
+
+	radio.SetSerial("SIMOTHER")
+	if uniqueID(t, radio) == id {
+		t.Error("radios with different serial numbers have the same fingerprint")
+	}
+}
+
+func TestRadioInfoWithoutUniqueID(t *testing.T) {
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	radio.SetReadProtected(true)
+
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	_, err = d.UniqueID()
+	if _, ok := err.(*dfu.ReadProtectedError); !ok {
+		t.Errorf("UniqueID error is %v, want a *ReadProtectedError", err)
+	}
+
+	info, err := d.RadioInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Bootloader || info.UniqueID != "" {
+		t.Errorf("got bootloader %v, UniqueID %q", info.Bootloader, info.UniqueID)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// internalFlashName begins the interface string of the internal flash.
+const internalFlashName = "@Internal Flash"
+
+// Sector is a flash sector described by a DfuSe interface string.
+type Sector struct {
+	Address  int
+	Size     int
+	Readable bool
+	Erasable bool
+	Writable bool
+}
+
+// MemoryLayout is a memory described by a DfuSe interface string.
+type MemoryLayout struct {
+	Name    string
+	Sectors []Sector
+}
+
+// ParseMemoryLayout parses a DfuSe interface string, such as
+// "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg".  After the
+// name come one or more address and sector list pairs.  Each sector
+// list entry is a count, a size in bytes, an optional K or M multiplier
+// and a letter from a to g giving the sectors' read (1), erase (2) and
+// write (4) permissions, with a being 1.
+func ParseMemoryLayout(desc string) (*MemoryLayout, error) {
+	if !strings.HasPrefix(desc, "@") {
+		return nil, fmt.Errorf("ParseMemoryLayout: %q does not start with '@'", desc)
+	}
+
+	fields := strings.Split(desc[1:], "/")
+	if len(fields) < 3 || len(fields)%2 != 1 {
+		return nil, fmt.Errorf("ParseMemoryLayout: %q: missing address or sectors", desc)
+	}
+
+	layout := &MemoryLayout{
+		Name: strings.TrimSpace(fields[0]),
+	}
+
+	for i := 1; i < len(fields); i += 2 {
+		address, err := strconv.ParseUint(strings.TrimSpace(fields[i]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ParseMemoryLayout: %q: bad address %q", desc, fields[i])
+		}
+		addr := int(address)
+
+		for _, spec := range strings.Split(fields[i+1], ",") {
+			count, sector, err := parseSectorSpec(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, fmt.Errorf("ParseMemoryLayout: %q: %s", desc, err.Error())
+			}
+
+			for j := 0; j < count; j++ {
+				sector.Address = addr
+				layout.Sectors = append(layout.Sectors, sector)
+				addr += sector.Size
+			}
+		}
+	}
+
+	return layout, nil
+}
+
+// parseSectorSpec parses a sector list entry such as "04*016Kg".
+func parseSectorSpec(spec string) (int, Sector, error) {
+	var sector Sector
+
+	star := strings.Index(spec, "*")
+	if star < 0 || len(spec) < star+3 {
+		return 0, sector, fmt.Errorf("bad sector list entry %q", spec)
+	}
+
+	count, err := strconv.Atoi(spec[:star])
+	if err != nil || count <= 0 {
+		return 0, sector, fmt.Errorf("bad sector count in %q", spec)
+	}
+
+	perm := spec[len(spec)-1]
+	if perm < 'a' || perm > 'g' {
+		return 0, sector, fmt.Errorf("bad sector type in %q", spec)
+	}
+	bits := perm - 'a' + 1
+	sector.Readable = bits&1 != 0
+	sector.Erasable = bits&2 != 0
+	sector.Writable = bits&4 != 0
+
+	size := spec[star+1 : len(spec)-1]
+	multiplier := 1
+	switch size[len(size)-1] {
+	case 'K':
+		multiplier = 1024
+		size = size[:len(size)-1]
+	case 'M':
+		multiplier = 1024 * 1024
+		size = size[:len(size)-1]
+	case ' ', 'B':
+		size = size[:len(size)-1]
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil || n <= 0 {
+		return 0, sector, fmt.Errorf("bad sector size in %q", spec)
+	}
+	sector.Size = n * multiplier
+
+	return count, sector, nil
+}
+
+// blocks returns the erasable and writable sectors of layout at or
+// above address, which must be contiguous.
+func (layout *MemoryLayout) blocks(address int) ([]block, error) {
+	var blocks []block
+	for _, sector := range layout.Sectors {
+		if sector.Address < address {
+			continue
+		}
+		if !sector.Erasable || !sector.Writable {
+			break
+		}
+		if len(blocks) > 0 {
+			last := blocks[len(blocks)-1]
+			if last.address+last.size != sector.Address {
+				break
+			}
+		}
+		blocks = append(blocks, block{sector.Address, sector.Size, sector.Size/1024 + 1})
+	}
+
+	if len(blocks) == 0 || blocks[0].address != address {
+		return nil, fmt.Errorf("no writable sector at 0x%08x", address)
+	}
+
+	return blocks, nil
+}
+
+// errNoLayout is returned by internalFlashLayout when the device does
+// not publish an internal flash layout.
+var errNoLayout = errors.New("internalFlashLayout: no internal flash interface string")
+
+// The bootloader publishes its internal flash in alternate setting 0
+// of interface 0.
+const (
+	internalFlashInterface  = 0
+	internalFlashAltSetting = 0
+)
+
+// maxStringDescriptor bounds the search for the interface string by a
+// Transport that is not an InterfaceDescriber.
+const maxStringDescriptor = 16
+
+// internalFlashLayout returns the internal flash layout published by
+// the bootloader in its interface string.  It returns errNoLayout if
+// there is none, and an error if there is one that does not parse.
+func (dfu *Dfu) internalFlashLayout() (*MemoryLayout, error) {
+	desc, err := dfu.internalFlashString()
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := ParseMemoryLayout(desc)
+	if err != nil {
+		return nil, wrapError("internalFlashLayout", err)
+	}
+
+	return layout, nil
+}
+
+// internalFlashString returns the interface string of the internal
+// flash alternate setting.  A Transport that is not an
+// InterfaceDescriber cannot say which string that is, so the first
+// maxStringDescriptor strings are searched for one naming internal
+// flash.
+func (dfu *Dfu) internalFlashString() (string, error) {
+	t := dfu.stDfu
+	if lt, ok := t.(*loggingTransport); ok {
+		t = lt.Transport
+	}
+
+	id, ok := t.(InterfaceDescriber)
+	if !ok {
+		for i := 1; i <= maxStringDescriptor; i++ {
+			desc, err := dfu.stDfu.GetStringDescriptor(i)
+			if err == nil && strings.HasPrefix(desc, internalFlashName) {
+				return desc, nil
+			}
+		}
+		return "", errNoLayout
+	}
+
+	desc, err := id.InterfaceDescription(internalFlashInterface, internalFlashAltSetting)
+	if err != nil {
+		return "", wrapError("internalFlashLayout", err)
+	}
+	if !strings.HasPrefix(desc, "@") {
+		return "", errNoLayout
+	}
+
+	return desc, nil
+}
+
+// firmwareBlocks returns the flash sectors available for firmware:
+// those published by the bootloader if it does so, otherwise
+// defaultFirmwareBlocks.  A published layout that does not parse, or
+// has no writable sectors for firmware, is an error.
+func (dfu *Dfu) firmwareBlocks() ([]block, error) {
+	layout, err := dfu.internalFlashLayout()
+	if err == errNoLayout {
+		return defaultFirmwareBlocks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := layout.blocks(appBase)
+	if err != nil {
+		return nil, wrapError("firmwareBlocks", err)
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+func TestParseMemoryLayout(t *testing.T) {
+	layout, err := dfu.ParseMemoryLayout("@Internal Flash /0x08000000/04*016Kg,01*064Kg,07*128Kg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if layout.Name != "Internal Flash" {
+		t.Errorf("name is %q", layout.Name)
+	}
+	if len(layout.Sectors) != 12 {
+		t.Fatalf("%d sectors, want 12", len(layout.Sectors))
+	}
+
+	address := 0x08000000
+	for i, sector := range layout.Sectors {
+		size := 128 * 1024
+		switch {
+		case i < 4:
+			size = 16 * 1024
+		case i == 4:
+			size = 64 * 1024
+		}
+		if sector.Address != address || sector.Size != size {
+			t.Errorf("sector %d is 0x%x bytes at 0x%08x, want 0x%x at 0x%08x", i, sector.Size, sector.Address, size, address)
+		}
+		if !sector.Readable || !sector.Erasable || !sector.Writable {
+			t.Errorf("sector %d is not readable, erasable and writable", i)
+		}
+		address += size
+	}
+	if address != 0x08100000 {
+		t.Errorf("sectors end at 0x%08x, want 0x08100000", address)
+	}
+}
+
+func TestParseMemoryLayoutPairs(t *testing.T) {
+	layout, err := dfu.ParseMemoryLayout("@OTP Memory /0x1FFF7800/01*512 e,01*016 e/0x20000000/02*1Ma")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dfu.Sector{
+		{Address: 0x1fff7800, Size: 512, Readable: true, Writable: true},
+		{Address: 0x1fff7a00, Size: 16, Readable: true, Writable: true},
+		{Address: 0x20000000, Size: 1024 * 1024, Readable: true},
+		{Address: 0x20100000, Size: 1024 * 1024, Readable: true},
+	}
+	if len(layout.Sectors) != len(want) {
+		t.Fatalf("%d sectors, want %d", len(layout.Sectors), len(want))
+	}
+	for i := range want {
+		if layout.Sectors[i] != want[i] {
+			t.Errorf("sector %d is %+v, want %+v", i, layout.Sectors[i], want[i])
+		}
+	}
+}
+
+func TestParseMemoryLayoutPermissions(t *testing.T) {
+	tests := []struct {
+		letter                       string
+		readable, erasable, writable bool
+	}{
+		{"a", true, false, false},
+		{"b", false, true, false},
+		{"c", true, true, false},
+		{"d", false, false, true},
+		{"e", true, false, true},
+		{"f", false, true, true},
+		{"g", true, true, true},
+	}
+
+	for _, test := range tests {
+		layout, err := dfu.ParseMemoryLayout("@Flash /0x08000000/01*016K" + test.letter)
+		if err != nil {
+			t.Errorf("%s: %s", test.letter, err)
+			continue
+		}
+		s := layout.Sectors[0]
+		if s.Readable != test.readable || s.Erasable != test.erasable || s.Writable != test.writable {
+			t.Errorf("%s: got readable %v, erasable %v, writable %v", test.letter, s.Readable, s.Erasable, s.Writable)
+		}
+	}
+}
+
+func TestParseMemoryLayoutErrors(t *testing.T) {
+	tests := []string{
+		"Internal Flash /0x08000000/04*016Kg",
+		"@Internal Flash",
+		"@Internal Flash /0x08000000",
+		"@Internal Flash /0x08000000/04*016Kg/0x08100000",
+		"@Internal Flash /flash/04*016Kg",
+		"@Internal Flash /0x08000000/",
+		"@Internal Flash /0x08000000/04016Kg",
+		"@Internal Flash /0x08000000/x*016Kg",
+		"@Internal Flash /0x08000000/00*016Kg",
+		"@Internal Flash /0x08000000/04*016Kh",
+		"@Internal Flash /0x08000000/04*016K",
+		"@Internal Flash /0x08000000/04*Kg",
+		"@Internal Flash /0x08000000/04*0Kg",
+		"@Internal Flash /0x08000000/04*016Kg,",
+		"@Internal Flash  /0x08000000/04*016Kx",
+	}
+
+	for _, desc := range tests {
+		layout, err := dfu.ParseMemoryLayout(desc)
+		if err == nil {
+			t.Errorf("%q: parsed as %+v", desc, layout)
+		}
+	}
+}
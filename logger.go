@@ -0,0 +1,235 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/dalefarnsworth-dmr/stdfu"
+)
+
+// A Logger receives structured log records.  Each record has a message
+// and alternating keys and values, as with log/slog, whose *slog.Logger
+// satisfies Logger.  Records carry an "op" key naming the operation in
+// progress and, for radios opened by Open with a selector, a "device"
+// key with the radio's USB path.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// A TraceLogger is a Logger with a level below Debug.  When tracing is
+// enabled, every DFU request and a hexdump of each block transferred
+// is logged at this level, or at Debug with a "trace" key if the
+// Logger is not a TraceLogger.
+type TraceLogger interface {
+	Logger
+	Trace(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+var (
+	defaultLogger Logger = nopLogger{}
+	defaultTrace  bool
+)
+
+// SetLogger sets the logger, and whether tracing is enabled, for radios
+// opened afterwards.  It should be called before any radio is opened.
+// A nil logger discards log records, as is the default.
+func SetLogger(l Logger, trace bool) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	defaultLogger = l
+	defaultTrace = trace
+}
+
+// SetLogger sets the logger, and whether tracing is enabled, for dfu.
+// A nil logger discards log records.
+func (dfu *Dfu) SetLogger(l Logger, trace bool) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	dfu.logger = l
+	dfu.trace = trace
+}
+
+// operation names op in the log records made until the returned
+// function is called, and logs its start and finish.  An operation
+// started by another keeps the outer operation's name.
+func (dfu *Dfu) operation(op string) func() {
+	if dfu.op != "" {
+		return func() {}
+	}
+
+	dfu.op = op
+	dfu.info("operation started")
+
+	return func() {
+		dfu.info("operation finished")
+		dfu.op = ""
+	}
+}
+
+func (dfu *Dfu) logArgs(args []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(args)+4)
+	if dfu.op != "" {
+		all = append(all, "op", dfu.op)
+	}
+	if dfu.device != nil {
+		all = append(all, "device", dfu.device.Path)
+	}
+
+	return append(all, args...)
+}
+
+func (dfu *Dfu) debug(msg string, args ...interface{}) {
+	dfu.logger.Debug(msg, dfu.logArgs(args)...)
+}
+
+func (dfu *Dfu) info(msg string, args ...interface{}) {
+	dfu.logger.Info(msg, dfu.logArgs(args)...)
+}
+
+func (dfu *Dfu) warn(msg string, args ...interface{}) {
+	dfu.logger.Warn(msg, dfu.logArgs(args)...)
+}
+
+func (dfu *Dfu) logError(msg string, args ...interface{}) {
+	dfu.logger.Error(msg, dfu.logArgs(args)...)
+}
+
+func (dfu *Dfu) traceLog(msg string, args ...interface{}) {
+	if !dfu.trace {
+		return
+	}
+
+	args = dfu.logArgs(args)
+	if t, ok := dfu.logger.(TraceLogger); ok {
+		t.Trace(msg, args...)
+		return
+	}
+	dfu.logger.Debug(msg, append(args, "trace", true)...)
+}
+
+var stateNames = map[stdfu.State]string{
+	stdfu.AppIdle:              "appIDLE",
+	stdfu.AppDetach:            "appDETACH",
+	stdfu.DfuIdle:              "dfuIDLE",
+	stdfu.DfuWriteSync:         "dfuDNLOAD-SYNC",
+	stdfu.DfuWriteBusy:         "dfuDNBUSY",
+	stdfu.DfuWriteIdle:         "dfuDNLOAD-IDLE",
+	stdfu.DfuManifestSync:      "dfuMANIFEST-SYNC",
+	stdfu.DfuManifest:          "dfuMANIFEST",
+	stdfu.DfuManifestWaitReset: "dfuMANIFEST-WAIT-RESET",
+	stdfu.DfuReadIdle:          "dfuUPLOAD-IDLE",
+	stdfu.DfuError:             "dfuERROR",
+}
+
+// stateName returns the DFU specification's name for state.
+func stateName(state stdfu.State) string {
+	name, ok := stateNames[state]
+	if !ok {
+		return fmt.Sprintf("state %d", int(state))
+	}
+	return name
+}
+
+// loggingTransport logs the requests dfu sends through its Transport.
+type loggingTransport struct {
+	Transport
+	dfu *Dfu
+}
+
+// setTransport arranges for dfu to communicate through t.
+func (dfu *Dfu) setTransport(t Transport) {
+	if lt, ok := t.(*loggingTransport); ok {
+		t = lt.Transport
+	}
+	s, ok := t.(Simulator)
+	dfu.simulated = ok && s.Simulated()
+	dfu.stDfu = &loggingTransport{t, dfu}
+}
+
+func (t *loggingTransport) result(request string, err error, args ...interface{}) error {
+	if err != nil {
+		t.dfu.logError(request+" failed", append(args, "err", err.Error())...)
+	}
+	return err
+}
+
+func (t *loggingTransport) Detach() error {
+	t.dfu.traceLog("Detach")
+	return t.result("Detach", t.Transport.Detach())
+}
+
+func (t *loggingTransport) Dnload(block int, data []byte) error {
+	if t.dfu.trace {
+		t.dfu.traceLog("Dnload", "block", block, "len", len(data), "data", hex.Dump(data))
+	}
+	return t.result("Dnload", t.Transport.Dnload(block, data), "block", block)
+}
+
+func (t *loggingTransport) Upload(block int, data []byte) error {
+	err := t.Transport.Upload(block, data)
+	if err == nil && t.dfu.trace {
+		t.dfu.traceLog("Upload", "block", block, "len", len(data), "data", hex.Dump(data))
+	}
+	return t.result("Upload", err, "block", block)
+}
+
+func (t *loggingTransport) GetStatus() (stdfu.DfuStatus, error) {
+	status, err := t.Transport.GetStatus()
+	if err == nil {
+		t.dfu.traceLog("GetStatus", "status", status.Status, "state", stateName(status.State), "pollTimeout", status.PollTimeout)
+	}
+	return status, t.result("GetStatus", err)
+}
+
+func (t *loggingTransport) ClrStatus() error {
+	t.dfu.traceLog("ClrStatus")
+	return t.result("ClrStatus", t.Transport.ClrStatus())
+}
+
+func (t *loggingTransport) GetState() (stdfu.State, error) {
+	state, err := t.Transport.GetState()
+	if err == nil {
+		t.dfu.traceLog("GetState", "state", stateName(state))
+	}
+	return state, t.result("GetState", err)
+}
+
+func (t *loggingTransport) Abort() error {
+	t.dfu.traceLog("Abort")
+	return t.result("Abort", t.Transport.Abort())
+}
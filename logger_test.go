@@ -0,0 +1,143 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package dfu_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// record is a log record.
+type record struct {
+	level string
+	msg   string
+	args  map[string]interface{}
+}
+
+// recordingLogger is a dfu.TraceLogger keeping the records it receives.
+type recordingLogger struct {
+	records []record
+}
+
+func (l *recordingLogger) log(level, msg string, args []interface{}) {
+	r := record{level, msg, make(map[string]interface{})}
+	for i := 0; i+1 < len(args); i += 2 {
+		r.args[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.records = append(l.records, r)
+}
+
+func (l *recordingLogger) Trace(msg string, args ...interface{}) { l.log("TRACE", msg, args) }
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+// debugLogger is a dfu.Logger that is not a dfu.TraceLogger.
+type debugLogger struct {
+	l *recordingLogger
+}
+
+func (l debugLogger) Debug(msg string, args ...interface{}) { l.l.Debug(msg, args...) }
+func (l debugLogger) Info(msg string, args ...interface{})  { l.l.Info(msg, args...) }
+func (l debugLogger) Warn(msg string, args ...interface{})  { l.l.Warn(msg, args...) }
+func (l debugLogger) Error(msg string, args ...interface{}) { l.l.Error(msg, args...) }
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name       string
+		trace      bool
+		traceLevel bool // the logger is a TraceLogger
+	}{
+		{"trace", true, true},
+		{"trace at debug", true, false},
+		{"no trace", false, true},
+	}
+
+	for _, test := range tests {
+		rl := &recordingLogger{}
+		var l dfu.Logger = rl
+		if !test.traceLevel {
+			l = debugLogger{rl}
+		}
+
+		d, err := dfu.NewWithTransport(sim.New("MD380"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.SetLogger(l, test.trace)
+
+		data := make([]byte, 2048)
+		err = d.ReadCodeplug(data)
+		d.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		records := rl.records
+		if len(records) < 2 {
+			t.Fatalf("%s: %d records", test.name, len(records))
+		}
+		first, last := records[0], records[len(records)-1]
+		if first.level != "INFO" || first.msg != "operation started" || first.args["op"] != "ReadCodeplug" {
+			t.Errorf("%s: first record is %+v, want ReadCodeplug started", test.name, first)
+		}
+		if last.level != "INFO" || last.msg != "operation finished" || last.args["op"] != "ReadCodeplug" {
+			t.Errorf("%s: last record is %+v, want ReadCodeplug finished", test.name, last)
+		}
+
+		var uploads int
+		for _, r := range records {
+			if r.args["op"] != "ReadCodeplug" {
+				t.Errorf("%s: record %q has op %v", test.name, r.msg, r.args["op"])
+			}
+			if r.msg != "Upload" {
+				continue
+			}
+			uploads++
+
+			if test.traceLevel && r.level != "TRACE" {
+				t.Errorf("%s: Upload logged at %s", test.name, r.level)
+			}
+			if !test.traceLevel && (r.level != "DEBUG" || r.args["trace"] != true) {
+				t.Errorf("%s: Upload logged at %s with trace %v", test.name, r.level, r.args["trace"])
+			}
+			dump, _ := r.args["data"].(string)
+			if r.args["len"] != 1024 || strings.Count(dump, "\n") != 64 {
+				t.Errorf("%s: Upload of %v bytes logged with a %d line hexdump", test.name, r.args["len"], strings.Count(dump, "\n"))
+			}
+		}
+		if test.trace && uploads != 2 {
+			t.Errorf("%s: %d uploads traced, want 2", test.name, uploads)
+		}
+		if !test.trace && uploads != 0 {
+			t.Errorf("%s: %d uploads traced with tracing disabled", test.name, uploads)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+)
+
+// An Option modifies the behavior of a write operation.
+type Option func(*options)
+
+type options struct {
+	force        bool
+	model        string
+	firmwareFunc func(fw *Firmware) error
+	cipher       *firmware.Cipher
+	generic      bool
+	policy       *FirmwarePolicy
+	keys         KeyRing
+	signature    *Signature
+	requireSig   bool
+	result       *Result
+	checked      bool
+	prompter     Prompter
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// Force skips the checks that an image suits the attached radio.
+func Force() Option {
+	return func(o *options) {
+		o.force = true
+	}
+}
+
+// Model declares the attached radio's model, for use where it cannot be
+// read from the radio, as when writing firmware in bootloader mode, or
+// where the radio reports a model that is not in Profiles.
+func Model(model string) Option {
+	return func(o *options) {
+		o.model = model
+	}
+}
+
+// FirmwareFunc arranges for f to be called with the validated firmware
+// before anything is erased.  If f returns an error, nothing is written.
+func FirmwareFunc(f func(fw *Firmware) error) Option {
+	return func(o *options) {
+		o.firmwareFunc = f
+	}
+}
+
+// Cipher arranges for WriteFirmware to encrypt a plaintext image with c
+// before writing it, and to check a TYT image's vector table after
+// decrypting it with c.
+func Cipher(c *firmware.Cipher) Option {
+	return func(o *options) {
+		o.cipher = c
+	}
+}
+
+// Generic arranges for WriteFirmware to treat the device as a plain
+// STM32 DfuSe bootloader rather than a TYT radio.  No TYT commands are
+// sent, and the image may occupy any writable internal flash sector
+// described by the bootloader's interface string.
+func Generic() Option {
+	return func(o *options) {
+		o.generic = true
+	}
+}
+
+// Policy arranges for WriteFirmware to refuse images that policy does
+// not accept, with a *PolicyError.
+func Policy(policy *FirmwarePolicy) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
+// RequireSignature arranges for a write operation to refuse, with a
+// *SignatureError, a file that sig does not show to be signed by one of
+// keys.  The check is made before the radio is modified.  A nil sig or
+// an empty keys refuses every file.
+func RequireSignature(sig *Signature, keys KeyRing) Option {
+	return func(o *options) {
+		o.requireSig = true
+		o.keys = keys
+		o.signature = sig
+	}
+}
+
+// Prompting arranges for a write operation to ask p for the operator
+// actions it needs, rather than failing with an *ActionRequiredError.
+func Prompting(p Prompter) Option {
+	return func(o *options) {
+		o.prompter = p
+	}
+}
+
+// Result receives information about a completed write operation.
+type Result struct {
+	SHA256 string // lower-case hex SHA-256 of the file written
+	Signer string // the verified signer, if a signature was required
+}
+
+// Report arranges for a write operation to fill in result.
+func Report(result *Result) Option {
+	return func(o *options) {
+		o.result = result
+	}
+}
+
+// checkFile checks the signature of data, the file being written, if
+// one is required, and records its hash and signer in the result.
+// Only the first file checked by an operation, the one the user
+// supplied, is considered.
+func (o *options) checkFile(data []byte) error {
+	if o.checked {
+		return nil
+	}
+
+	if o.requireSig {
+		if len(o.keys) == 0 {
+			return &SignatureError{Reason: "no trusted keys"}
+		}
+		err := o.keys.Verify(data, o.signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.result != nil {
+		sum := sha256.Sum256(data)
+		o.result.SHA256 = hex.EncodeToString(sum[:])
+		if o.requireSig {
+			o.result.Signer = o.signature.Signer
+		}
+	}
+
+	o.checked = true
+
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// The general settings of all supported models hold the radio ID as
+// a 24-bit little-endian number and the radio name as up to 16
+// UTF-16LE characters, zero padded.  The offsets are those used by
+// dmrconfig.
+const (
+	maxRadioID        = 0xffffff
+	radioNameLen      = 16
+	radioNameByteSize = 2 * radioNameLen
+)
+
+// checkPersonalize checks that codeplug suits p and holds field at
+// offset.
+func (p *Profile) checkPersonalize(codeplug []byte, offset, size int) error {
+	if len(codeplug) != p.CodeplugSize {
+		return fmt.Errorf("codeplug size is %d, want %d", len(codeplug), p.CodeplugSize)
+	}
+	if offset == 0 || offset+size > len(codeplug) {
+		return fmt.Errorf("%s codeplug layout is unknown", p.Name)
+	}
+
+	return nil
+}
+
+// RadioID returns the radio ID held in codeplug, a codeplug for p.
+func (p *Profile) RadioID(codeplug []byte) (int, error) {
+	err := p.checkPersonalize(codeplug, p.RadioIDOffset, 3)
+	if err != nil {
+		return 0, wrapError("RadioID", err)
+	}
+
+	b := codeplug[p.RadioIDOffset:]
+
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16, nil
+}
+
+// SetRadioID sets the radio ID held in codeplug, a codeplug for p.
+func (p *Profile) SetRadioID(codeplug []byte, id int) error {
+	err := p.checkPersonalize(codeplug, p.RadioIDOffset, 3)
+	if err != nil {
+		return wrapError("SetRadioID", err)
+	}
+	if id < 1 || id > maxRadioID {
+		return fmt.Errorf("SetRadioID: radio ID %d out of range", id)
+	}
+
+	b := codeplug[p.RadioIDOffset:]
+	b[0] = byte(id)
+	b[1] = byte(id >> 8)
+	b[2] = byte(id >> 16)
+
+	return nil
+}
+
+// RadioName returns the radio name held in codeplug, a codeplug for p.
+func (p *Profile) RadioName(codeplug []byte) (string, error) {
+	err := p.checkPersonalize(codeplug, p.RadioNameOffset, radioNameByteSize)
+	if err != nil {
+		return "", wrapError("RadioName", err)
+	}
+
+	b := codeplug[p.RadioNameOffset:]
+	var chars []uint16
+	for i := 0; i < radioNameLen; i++ {
+		c := binary.LittleEndian.Uint16(b[2*i:])
+		if c == 0 || c == 0xffff {
+			break
+		}
+		chars = append(chars, c)
+	}
+
+	return string(utf16.Decode(chars)), nil
+}
+
+// SetRadioName sets the radio name held in codeplug, a codeplug for p.
+func (p *Profile) SetRadioName(codeplug []byte, name string) error {
+	err := p.checkPersonalize(codeplug, p.RadioNameOffset, radioNameByteSize)
+	if err != nil {
+		return wrapError("SetRadioName", err)
+	}
+
+	chars := utf16.Encode([]rune(name))
+	if len(chars) > radioNameLen {
+		return fmt.Errorf("SetRadioName: %q is longer than %d characters", name, radioNameLen)
+	}
+
+	b := codeplug[p.RadioNameOffset : p.RadioNameOffset+radioNameByteSize]
+	for i := range b {
+		b[i] = 0
+	}
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+
+	return nil
+}
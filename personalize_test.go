@@ -0,0 +1,119 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+func TestRadioID(t *testing.T) {
+	p := dfu.LookupProfile("MD380")
+	codeplug := testCodeplug(1)
+	original := append([]byte(nil), codeplug...)
+
+	err := p.SetRadioID(codeplug, 3100123) // 0x2f4ddb
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(codeplug[0x2084:0x2087], []byte{0xdb, 0x4d, 0x2f}) {
+		t.Errorf("radio ID stored as % x", codeplug[0x2084:0x2087])
+	}
+	copy(codeplug[0x2084:0x2087], original[0x2084:])
+	if !bytes.Equal(codeplug, original) {
+		t.Error("bytes other than the radio ID changed")
+	}
+
+	for _, id := range []int{1, 3100123, 0xffffff} {
+		err = p.SetRadioID(codeplug, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.RadioID(codeplug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != id {
+			t.Errorf("radio ID %d read back as %d", id, got)
+		}
+	}
+
+	for _, id := range []int{0, -1, 0x1000000} {
+		if p.SetRadioID(codeplug, id) == nil {
+			t.Errorf("radio ID %d accepted", id)
+		}
+	}
+	if p.SetRadioID(codeplug[:1024], 1) == nil {
+		t.Error("radio ID set in a short codeplug")
+	}
+}
+
+func TestRadioName(t *testing.T) {
+	p := dfu.LookupProfile("MD380")
+	codeplug := testCodeplug(1)
+	original := append([]byte(nil), codeplug...)
+
+	err := p.SetRadioName(codeplug, "Unit 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 32)
+	copy(want, []byte{'U', 0, 'n', 0, 'i', 0, 't', 0, ' ', 0, '1', 0})
+	if !bytes.Equal(codeplug[0x20b0:0x20d0], want) {
+		t.Errorf("radio name stored as % x", codeplug[0x20b0:0x20d0])
+	}
+	copy(codeplug[0x20b0:0x20d0], original[0x20b0:])
+	if !bytes.Equal(codeplug, original) {
+		t.Error("bytes other than the radio name changed")
+	}
+
+	// A character outside the Basic Multilingual Plane takes two
+	// UTF-16 code units.
+	for _, name := range []string{"", "Unit 1", "Größe", "Ham \U0001f4fb", "0123456789abcdef"} {
+		err = p.SetRadioName(codeplug, name)
+		if err != nil {
+			t.Fatalf("%q: %s", name, err)
+		}
+		got, err := p.RadioName(codeplug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != name {
+			t.Errorf("radio name %q read back as %q", name, got)
+		}
+	}
+
+	for _, name := range []string{"0123456789abcdefg", "0123456789abcde\U0001f4fb"} {
+		if p.SetRadioName(codeplug, name) == nil {
+			t.Errorf("%q accepted, longer than 16 UTF-16 characters", name)
+		}
+	}
+	if p.SetRadioName(codeplug[:1024], "Unit 1") == nil {
+		t.Error("radio name set in a short codeplug")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FirmwarePolicy restricts the firmware images WriteFirmware accepts.
+// It is checked after the image is validated and before anything is
+// erased.
+type FirmwarePolicy struct {
+	// Allowed holds the lower-case hex SHA-256 hashes of approved
+	// firmware files.  If it is empty there is no allowlist, and
+	// images are not refused for being missing from it.
+	Allowed map[string]bool
+
+	// Versions maps the lower-case hex SHA-256 hashes of firmware
+	// files to their versions.  TYT headers record no version, so
+	// this is the only source of one for a TYT image.  For other
+	// images it overrides the version recorded in the file.
+	Versions map[string]string
+
+	// MinVersion, if not empty, is the oldest firmware version
+	// accepted.  It applies to every image, including those in
+	// Allowed, though an image in Allowed whose version cannot be
+	// determined is accepted.
+	MinVersion string
+
+	// AllowUnknown permits images that are not in a non-empty
+	// Allowed, or whose version cannot be determined.  Images known
+	// to be older than MinVersion are refused regardless.
+	AllowUnknown bool
+}
+
+// PolicyError is returned when a FirmwarePolicy refuses an image.
+type PolicyError struct {
+	SHA256 string // hash of the refused image
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("WriteFirmware: firmware %s refused by policy: %s", e.SHA256, e.Reason)
+}
+
+// Check returns a *PolicyError if policy refuses fw.
+func (policy *FirmwarePolicy) Check(fw *Firmware) error {
+	refuse := func(format string, args ...interface{}) error {
+		return &PolicyError{
+			SHA256: fw.SHA256,
+			Reason: fmt.Sprintf(format, args...),
+		}
+	}
+
+	allowed := policy.Allowed[fw.SHA256]
+	if len(policy.Allowed) != 0 && !allowed && !policy.AllowUnknown {
+		return refuse("image is not on the allowlist")
+	}
+
+	if policy.MinVersion != "" {
+		version, ok := policy.Versions[fw.SHA256]
+		if !ok {
+			version = fw.Version
+		}
+
+		cmp, ok := compareVersions(version, policy.MinVersion)
+		switch {
+		case !ok && !allowed && !policy.AllowUnknown:
+			return refuse("version %q cannot be compared with minimum %q", version, policy.MinVersion)
+		case ok && cmp < 0:
+			return refuse("version %s is older than minimum %s", version, policy.MinVersion)
+		}
+	}
+
+	return nil
+}
+
+// compareVersions compares the numeric parts of two version strings,
+// such as "D013.020" and "D13.34".  It returns -1, 0 or 1 as a is
+// older than, the same as or newer than b, and false if either has no
+// numeric parts.
+func compareVersions(a, b string) (int, bool) {
+	av := versionNumbers(a)
+	bv := versionNumbers(b)
+	if len(av) == 0 || len(bv) == 0 {
+		return 0, false
+	}
+
+	for i := 0; i < len(av) || i < len(bv); i++ {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		if x < y {
+			return -1, true
+		}
+		if x > y {
+			return 1, true
+		}
+	}
+
+	return 0, true
+}
+
+// versionNumbers returns the runs of digits in version as integers.
+func versionNumbers(version string) []int {
+	fields := strings.FieldsFunc(version, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+
+	var numbers []int
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil
+		}
+		numbers = append(numbers, n)
+	}
+
+	return numbers
+}
@@ -0,0 +1,125 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+func TestFirmwarePolicy(t *testing.T) {
+	const (
+		old     = "0000000000000000000000000000000000000000000000000000000000000001"
+		current = "0000000000000000000000000000000000000000000000000000000000000002"
+		unknown = "0000000000000000000000000000000000000000000000000000000000000003"
+	)
+
+	tests := []struct {
+		name   string
+		policy dfu.FirmwarePolicy
+		fw     dfu.Firmware
+		ok     bool
+	}{
+		{"allowed", dfu.FirmwarePolicy{
+			Allowed: map[string]bool{current: true},
+		}, dfu.Firmware{SHA256: current}, true},
+		{"not allowed", dfu.FirmwarePolicy{
+			Allowed: map[string]bool{current: true},
+		}, dfu.Firmware{SHA256: unknown}, false},
+		{"allowed but old", dfu.FirmwarePolicy{
+			Allowed:    map[string]bool{old: true},
+			Versions:   map[string]string{old: "D013.014"},
+			MinVersion: "D013.020",
+		}, dfu.Firmware{SHA256: old}, false},
+		{"allowed without version", dfu.FirmwarePolicy{
+			Allowed:    map[string]bool{current: true},
+			MinVersion: "D013.020",
+		}, dfu.Firmware{SHA256: current}, true},
+		{"min version only", dfu.FirmwarePolicy{
+			Versions:   map[string]string{current: "D013.020"},
+			MinVersion: "D013.020",
+		}, dfu.Firmware{SHA256: current}, true},
+		{"min version only, old", dfu.FirmwarePolicy{
+			Versions:   map[string]string{old: "D013.014"},
+			MinVersion: "D013.020",
+		}, dfu.Firmware{SHA256: old}, false},
+		{"not allowed, unknown allowed", dfu.FirmwarePolicy{
+			Allowed:      map[string]bool{current: true},
+			AllowUnknown: true,
+		}, dfu.Firmware{SHA256: unknown}, true},
+		{"old", dfu.FirmwarePolicy{
+			Versions:     map[string]string{old: "D013.014"},
+			MinVersion:   "D013.020",
+			AllowUnknown: true,
+		}, dfu.Firmware{SHA256: old}, false},
+		{"current", dfu.FirmwarePolicy{
+			Versions:     map[string]string{current: "D013.020"},
+			MinVersion:   "D013.020",
+			AllowUnknown: true,
+		}, dfu.Firmware{SHA256: current}, true},
+		{"no version", dfu.FirmwarePolicy{
+			MinVersion: "D013.020",
+		}, dfu.Firmware{SHA256: unknown}, false},
+		{"no version allowed", dfu.FirmwarePolicy{
+			MinVersion:   "D013.020",
+			AllowUnknown: true,
+		}, dfu.Firmware{SHA256: unknown}, true},
+		{"file version", dfu.FirmwarePolicy{
+			MinVersion:   "2.0",
+			AllowUnknown: true,
+		}, dfu.Firmware{SHA256: unknown, Version: "1.13"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.policy.Check(&test.fw)
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok {
+			if _, ok := err.(*dfu.PolicyError); !ok {
+				t.Errorf("%s: got error %v, want a *PolicyError", test.name, err)
+			}
+		}
+	}
+}
+
+func TestDfuSeFirmwareVersion(t *testing.T) {
+	img := &dfu.DfuSeImage{
+		DeviceVersion: 0x0213,
+		ProductID:     0xdf11,
+		VendorID:      0x0483,
+		Targets: []dfu.DfuSeTarget{{
+			Elements: []dfu.Segment{{Address: 0x0800c000, Data: make([]byte, 16)}},
+		}},
+	}
+
+	fw, err := dfu.ParseFirmware(img.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.Version != "2.13" {
+		t.Errorf("version is %q, want 2.13", fw.Version)
+	}
+}
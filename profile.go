@@ -0,0 +1,274 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/dalefarnsworth-dmr/dfu/firmware"
+)
+
+// UsersFormat identifies how a radio model stores its users database.
+type UsersFormat int
+
+const (
+	MD380Users UsersFormat = iota // text in SPI flash, see WriteMD380Users
+	UV380Users                    // binary image, see WriteUV380Users
+)
+
+// Profile describes a radio model.
+type Profile struct {
+	Name            string      // canonical model name
+	Aliases         []string    // other names reported by radios or CPS files
+	CodeplugSize    int         // size of the raw codeplug image in bytes
+	UsersFormat     UsersFormat // format of the users database
+	RadioIDOffset   int         // codeplug offset of the 24-bit radio ID
+	RadioNameOffset int         // codeplug offset of the UTF-16 radio name
+	FirmwareRadio   []byte      // radio field of its TYT firmware headers, if known
+}
+
+// Profiles lists the radio models known to this package.
+var Profiles = []*Profile{
+	&Profile{
+		Name:            "MD380",
+		Aliases:         []string{"DR780", "RT3"},
+		CodeplugSize:    256 * 1024,
+		UsersFormat:     MD380Users,
+		RadioIDOffset:   0x2084,
+		RadioNameOffset: 0x20b0,
+		FirmwareRadio:   firmware.MD380Radio,
+	},
+	&Profile{
+		Name:            "MD390",
+		Aliases:         []string{"RT8"},
+		CodeplugSize:    256 * 1024,
+		UsersFormat:     MD380Users,
+		RadioIDOffset:   0x2084,
+		RadioNameOffset: 0x20b0,
+		FirmwareRadio:   firmware.MD380Radio,
+	},
+	&Profile{
+		Name:            "UV380",
+		Aliases:         []string{"RT3S"},
+		CodeplugSize:    832 * 1024,
+		UsersFormat:     UV380Users,
+		RadioIDOffset:   0x2084,
+		RadioNameOffset: 0x20b0,
+	},
+	&Profile{
+		Name:            "UV390",
+		CodeplugSize:    832 * 1024,
+		UsersFormat:     UV380Users,
+		RadioIDOffset:   0x2084,
+		RadioNameOffset: 0x20b0,
+	},
+	&Profile{
+		Name:            "MD2017",
+		Aliases:         []string{"RT82"},
+		CodeplugSize:    832 * 1024,
+		UsersFormat:     UV380Users,
+		RadioIDOffset:   0x2084,
+		RadioNameOffset: 0x20b0,
+	},
+}
+
+// normalizeModel removes the differences found among the ways a model
+// name is written, e.g. "MD-380", "md380" and "380", or "MD-UV380" and
+// "UV380".
+func normalizeModel(model string) string {
+	model = strings.ToUpper(model)
+	model = strings.Replace(model, "-", "", -1)
+	model = strings.Replace(model, " ", "", -1)
+
+	return strings.TrimPrefix(model, "MD")
+}
+
+// LookupProfile returns the profile for the named model, or nil if
+// the model is unknown.
+func LookupProfile(model string) *Profile {
+	model = normalizeModel(model)
+	if model == "" {
+		return nil
+	}
+
+	for _, p := range Profiles {
+		if normalizeModel(p.Name) == model {
+			return p
+		}
+		for _, alias := range p.Aliases {
+			if normalizeModel(alias) == model {
+				return p
+			}
+		}
+	}
+
+	return nil
+}
+
+// readModel returns the model name reported by the radio.
+func (dfu *Dfu) readModel() (string, error) {
+	_, err := dfu.init()
+	if err != nil {
+		return "", wrapError("readModel", err)
+	}
+
+	err = dfu.md380Cmd([]md380Cmd{
+		md380Cmd{0x91, 0x01}, // Programming Mode
+		md380Cmd{0xa2, 0x01}, // Model
+	})
+	if err != nil {
+		return "", wrapError("readModel", err)
+	}
+
+	cmd, err := dfu.getCommand()
+	if err != nil {
+		return "", wrapError("readModel", err)
+	}
+
+	err = dfu.enterDfuMode()
+	if err != nil {
+		return "", wrapError("readModel", err)
+	}
+
+	end := bytes.IndexAny(cmd, "\x00\xff")
+	if end < 0 {
+		end = len(cmd)
+	}
+
+	return strings.TrimSpace(string(cmd[:end])), nil
+}
+
+// Profile returns the profile of the attached radio.  The radio is
+// only asked for its model once.
+func (dfu *Dfu) Profile() (*Profile, error) {
+	defer dfu.operation("Profile")()
+
+	if dfu.profile != nil {
+		return dfu.profile, nil
+	}
+
+	model, err := dfu.readModel()
+	if err != nil {
+		return nil, wrapError("Profile", err)
+	}
+
+	profile := LookupProfile(model)
+	if profile == nil {
+		return nil, &UnknownModelError{
+			Op:    "Profile",
+			Model: model,
+		}
+	}
+
+	dfu.profile = profile
+
+	return profile, nil
+}
+
+// UnknownModelError is returned when the radio reports a model that is
+// not in Profiles, so an image cannot be checked against it.  The Model
+// option names the radio's model, and Force skips the check.  It is
+// returned unwrapped so callers may test for it with a type assertion.
+type UnknownModelError struct {
+	Op    string // the operation that was refused
+	Model string // the model the radio reported
+}
+
+func (e *UnknownModelError) Error() string {
+	return fmt.Sprintf("%s: unknown radio model %q", e.Op, e.Model)
+}
+
+// radioProfile returns the profile of the attached radio, or, if the
+// radio reports an unknown model, of the model named by the Model
+// option.
+func (dfu *Dfu) radioProfile(op string, o *options) (*Profile, error) {
+	profile, err := dfu.Profile()
+	if err == nil {
+		return profile, nil
+	}
+
+	e, ok := err.(*UnknownModelError)
+	if !ok {
+		return nil, wrapError(op, err)
+	}
+	if o.model != "" {
+		profile = LookupProfile(o.model)
+		if profile != nil {
+			return profile, nil
+		}
+		e.Model = o.model
+	}
+	e.Op = op
+
+	return nil, e
+}
+
+// MismatchError is returned when an image does not suit the radio.
+// It is returned unwrapped so callers may test for it with a type
+// assertion.
+type MismatchError struct {
+	Op     string // the operation that was refused
+	Model  string // the radio's model
+	Reason string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s: image does not match %s radio: %s", e.Op, e.Model, e.Reason)
+}
+
+// checkCodeplug returns a *MismatchError if a codeplug of len(data)
+// bytes, from a file naming model, cannot be written to the radio, or
+// an *UnknownModelError if the radio's model is not known.
+//
+// A raw codeplug image does not record the model it is for: the TYT
+// CPS keeps the model name in the CPS block of an .rdt file, which
+// WriteCodeplugRDT passes as model.  Models that share a codeplug
+// size, such as the MD380 and MD390, or the UV380, UV390 and MD2017,
+// can therefore only be told apart when model is not empty.
+func (dfu *Dfu) checkCodeplug(op string, data []byte, model string, o *options) error {
+	profile, err := dfu.radioProfile(op, o)
+	if err != nil {
+		return err
+	}
+
+	if len(data) != profile.CodeplugSize {
+		return &MismatchError{
+			Op:     op,
+			Model:  profile.Name,
+			Reason: fmt.Sprintf("codeplug size is %d, want %d", len(data), profile.CodeplugSize),
+		}
+	}
+
+	if model != "" && LookupProfile(model) != profile {
+		return &MismatchError{
+			Op:     op,
+			Model:  profile.Name,
+			Reason: fmt.Sprintf("codeplug is for model %q", model),
+		}
+	}
+
+	return nil
+}
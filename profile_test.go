@@ -0,0 +1,138 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+func TestWriteCodeplugMismatch(t *testing.T) {
+	uv380Size := dfu.LookupProfile("UV380").CodeplugSize
+
+	tests := []struct {
+		name  string
+		write func(d *dfu.Dfu) error
+	}{
+		{"size", func(d *dfu.Dfu) error {
+			return d.WriteCodeplug(make([]byte, uv380Size))
+		}},
+		{"rdt model", func(d *dfu.Dfu) error {
+			rdt := &dfu.RDT{Model: "MD390", Codeplug: testCodeplug(0)}
+			return d.WriteCodeplugRDT(bytes.NewReader(rdt.Bytes()))
+		}},
+		{"rdt family", func(d *dfu.Dfu) error {
+			rdt := &dfu.RDT{Model: "MD-UV380", Codeplug: testCodeplug(0)}
+			return d.WriteCodeplugRDT(bytes.NewReader(rdt.Bytes()))
+		}},
+	}
+
+	for _, test := range tests {
+		radio := sim.New("MD380")
+		d, err := dfu.NewWithTransport(radio, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = test.write(d)
+		d.Close()
+		if _, ok := err.(*dfu.MismatchError); !ok {
+			t.Errorf("%s: got error %v, want a *MismatchError", test.name, err)
+		}
+		if radio.Flash(0, 1)[0] != 0xff {
+			t.Errorf("%s: the radio was written", test.name)
+		}
+	}
+}
+
+func TestWriteCodeplugUnknownModel(t *testing.T) {
+	radio := sim.New("XR-9")
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.WriteCodeplug(testCodeplug(0))
+	if e, ok := err.(*dfu.UnknownModelError); !ok || e.Model != "XR-9" {
+		t.Errorf("got error %v, want an *UnknownModelError for XR-9", err)
+	}
+
+	// Naming the model lets the codeplug be checked against it.
+	err = d.WriteCodeplug(testCodeplug(0), dfu.Model("UV380"))
+	if _, ok := err.(*dfu.MismatchError); !ok {
+		t.Errorf("got error %v, want a *MismatchError", err)
+	}
+
+	if radio.Flash(0, 1)[0] != 0xff {
+		t.Error("the radio was written")
+	}
+}
+
+func TestWriteRawUsersUnknownModel(t *testing.T) {
+	// UV380 users images are written in whole flash blocks.
+	data := make([]byte, 1024)
+	copy(data, "20\n3100001,N0CALL,Test\n")
+
+	tests := []struct {
+		name    string
+		opts    []dfu.Option
+		written func(r *sim.Radio) []byte // nil if the write is refused
+	}{
+		{"no options", nil, nil},
+		{"model", []dfu.Option{dfu.Model("UV380")}, func(r *sim.Radio) []byte {
+			return r.Flash(0x200000, len(data))
+		}},
+		{"force", []dfu.Option{dfu.Force()}, func(r *sim.Radio) []byte {
+			return r.SPIFlash(0x100000, len(data))
+		}},
+	}
+
+	for _, test := range tests {
+		radio := sim.New("XR-9")
+		d, err := dfu.NewWithTransport(radio, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.WriteRawUsers(bytes.NewReader(data), len(data), test.opts...)
+		d.Close()
+		if test.written == nil {
+			if _, ok := err.(*dfu.UnknownModelError); !ok {
+				t.Errorf("%s: got error %v, want an *UnknownModelError", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(test.written(radio), data) {
+			t.Errorf("%s: image not written in the expected format", test.name)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An Action is a physical step that only an operator can take.
+type Action int
+
+const (
+	EnterBootloader Action = iota // restart the radio in bootloader mode
+	PowerCycle                    // turn the radio off and on again
+	ReconnectUSB                  // reconnect the radio's USB cable
+)
+
+var actionNames = []string{
+	EnterBootloader: "enter-bootloader",
+	PowerCycle:      "power-cycle",
+	ReconnectUSB:    "reconnect-usb",
+}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+	return actionNames[a]
+}
+
+// Instructions returns directions for taking the action, suitable for
+// showing to the operator.
+func (a Action) Instructions() string {
+	switch a {
+	case EnterBootloader:
+		return "Enter bootloader mode by holding down the PTT button and the button above it while turning on the radio.  The radio's LED will blink green and red."
+	case PowerCycle:
+		return "Turn the radio off, then turn it on again."
+	case ReconnectUSB:
+		return "Unplug the radio's USB cable, plug it in again and make sure the radio is turned on."
+	}
+	return a.String()
+}
+
+// A Prompt asks an operator to take an action.
+type Prompt struct {
+	Action  Action
+	Reason  string // why the action is needed
+	Attempt int    // 1, then counting up while the radio is not ready
+}
+
+// A Prompter asks an operator to take physical actions.  Prompt should
+// return once the operator reports the action taken, or return an
+// error to give up.  The caller then waits a while for the radio to
+// become ready and, if it does not, prompts again with the next
+// Attempt.
+type Prompter interface {
+	Prompt(p *Prompt) error
+}
+
+// PrompterFunc adapts a function to a Prompter.
+type PrompterFunc func(p *Prompt) error
+
+func (f PrompterFunc) Prompt(p *Prompt) error {
+	return f(p)
+}
+
+// ActionRequiredError is returned when an operation needs an operator
+// action and no Prompter was given.  It is returned unwrapped so
+// callers may test for it with a type assertion.
+type ActionRequiredError struct {
+	Op     string // the operation that needs the action
+	Action Action
+	Reason string
+}
+
+func (e *ActionRequiredError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Reason)
+}
+
+// promptWait is how long the radio has to become ready after each
+// prompt before the operator is prompted again.
+const promptWait = 15 * time.Second
+
+// await asks p to take action, then calls wait, which should return
+// once the radio is ready.  It prompts again each time wait fails to
+// return within promptWait, until p or ctx gives up.
+func await(ctx context.Context, p Prompter, action Action, reason string, wait func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := p.Prompt(&Prompt{Action: action, Reason: reason, Attempt: attempt})
+		if err != nil {
+			return err
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, promptWait)
+		err = wait(waitCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// OpenPrompting opens the radio chosen by selector, as Open does.  If
+// the radio cannot be opened, it asks p to have it reconnected, or
+// power-cycled if it did not respond, and tries again, until p or ctx
+// gives up.
+func OpenPrompting(ctx context.Context, selector string, p Prompter, progressCallback func(progressCounter int) error) (*Dfu, error) {
+	return openPrompting(ctx, p, func() (*Dfu, error) {
+		return Open(selector, progressCallback)
+	})
+}
+
+// openPrompting is OpenPrompting, opening the radio with open.
+func openPrompting(ctx context.Context, p Prompter, open func() (*Dfu, error)) (*Dfu, error) {
+	dfu, err := open()
+	if err == nil {
+		return dfu, nil
+	}
+
+	action := ReconnectUSB
+	reason := err.Error()
+	if e, ok := err.(*ActionRequiredError); ok {
+		action = e.Action
+		reason = e.Reason
+	}
+
+	err = await(ctx, p, action, reason, func(ctx context.Context) error {
+		return poll(ctx, func() (bool, error) {
+			dfu, err = open()
+			return err == nil, err
+		})
+	})
+	if err != nil {
+		return nil, wrapError("OpenPrompting", err)
+	}
+
+	return dfu, nil
+}
+
+// awaitBootloader asks p to restart the radio in bootloader mode and
+// carries on with the radio once it returns in that mode.
+func (dfu *Dfu) awaitBootloader(p Prompter) error {
+	selector := ""
+	if dfu.device != nil {
+		selector = dfu.device.Path
+	}
+
+	// The radio's ID, if the MCU's unique device ID can be read,
+	// confirms that the radio that enters bootloader mode is the same
+	// one.  A fingerprint is not reported in bootloader mode.
+	id, _ := dfu.UniqueID()
+	if !strings.HasPrefix(id, uniqueIDPrefix) {
+		id = ""
+	}
+
+	// The radio leaves the bus when it restarts.
+	dfu.stDfu.Close()
+
+	err := await(context.Background(), p, EnterBootloader, "the radio is not in bootloader mode", func(ctx context.Context) error {
+		return poll(ctx, func() (bool, error) {
+			n, err := Open(selector, dfu.progressCallback)
+			if err != nil {
+				return false, err
+			}
+			if !n.bootloader {
+				n.Close()
+				return false, nil
+			}
+
+			newID, _ := n.UniqueID()
+			if id != "" && newID != id {
+				n.Close()
+				return false, fmt.Errorf("radio %q entered bootloader mode in place of %s", newID, id)
+			}
+
+			dfu.setTransport(n.stDfu)
+			dfu.device = n.device
+			dfu.serial = n.serial
+			dfu.bootloader = true
+			dfu.uniqueID = newID
+
+			return true, nil
+		})
+	})
+	if err != nil {
+		dfu.closed = true
+		return err
+	}
+	dfu.info("radio entered bootloader mode")
+
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The TYT CPS .rdt file is a DfuSe file containing a single element.
+// The element's data is a 256-byte CPS block, holding the radio model
+// name, followed by the raw codeplug image.  The file ends with the
+// 16-byte DfuSe suffix.
+const (
+	rdtPrefixSize      = 11
+	rdtTargetSize      = 274
+	rdtElementSize     = 8
+	rdtCPSBlockSize    = 256
+	rdtHeaderSize      = rdtPrefixSize + rdtTargetSize + rdtElementSize + rdtCPSBlockSize
+	rdtTrailerSize     = 16
+	rdtImageSizeOffset = 6
+	rdtElemSizeOffset  = rdtPrefixSize + rdtTargetSize + 4
+	rdtModelOffset     = rdtPrefixSize + rdtTargetSize + rdtElementSize
+	rdtModelSize       = 16
+)
+
+// RDT is a codeplug in the TYT CPS .rdt container.
+type RDT struct {
+	Model    string // radio model named in the header
+	Codeplug []byte // the raw codeplug image
+
+	header []byte // the original header, if read from a file
+}
+
+// ReadRDT reads and parses an .rdt file.
+func ReadRDT(rdr io.Reader) (*RDT, error) {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, wrapError("ReadRDT", err)
+	}
+
+	return ParseRDT(data)
+}
+
+// ParseRDT strips the .rdt header and trailer from data, checking
+// the trailer CRC and that the header is consistent with the size of
+// the file.
+func ParseRDT(data []byte) (*RDT, error) {
+	if len(data) < rdtHeaderSize+rdtTrailerSize {
+		return nil, errors.New("ParseRDT: file too short")
+	}
+	if string(data[:5]) != "DfuSe" {
+		return nil, errors.New("ParseRDT: bad header signature")
+	}
+	trailer := data[len(data)-rdtTrailerSize:]
+	if string(trailer[8:11]) != "UFD" {
+		return nil, errors.New("ParseRDT: bad trailer signature")
+	}
+	if binary.LittleEndian.Uint32(trailer[12:]) != dfuseCRC(data[:len(data)-4]) {
+		return nil, errors.New("ParseRDT: bad CRC")
+	}
+
+	imageSize := int(binary.LittleEndian.Uint32(data[rdtImageSizeOffset:]))
+	if imageSize != len(data)-rdtTrailerSize {
+		return nil, fmt.Errorf("ParseRDT: header size %d does not match file size %d", imageSize+rdtTrailerSize, len(data))
+	}
+
+	size := len(data) - rdtHeaderSize - rdtTrailerSize
+	elemSize := int(binary.LittleEndian.Uint32(data[rdtElemSizeOffset:]))
+	if elemSize != rdtCPSBlockSize+size {
+		return nil, fmt.Errorf("ParseRDT: header codeplug size %d does not match file codeplug size %d", elemSize-rdtCPSBlockSize, size)
+	}
+	if size == 0 || size%1024 != 0 {
+		return nil, fmt.Errorf("ParseRDT: bad codeplug size %d", size)
+	}
+
+	model := rdtModel(data[rdtModelOffset : rdtModelOffset+rdtModelSize])
+	if model == "" {
+		return nil, errors.New("ParseRDT: header has no model name")
+	}
+
+	rdt := &RDT{
+		Model:    model,
+		Codeplug: append([]byte(nil), data[rdtHeaderSize:rdtHeaderSize+size]...),
+		header:   append([]byte(nil), data[:rdtHeaderSize]...),
+	}
+
+	return rdt, nil
+}
+
+// rdtModel returns the model name held in field, or "" if the field
+// does not hold a printable name.
+func rdtModel(field []byte) string {
+	end := bytes.IndexAny(field, "\x00\xff")
+	if end < 0 {
+		end = len(field)
+	}
+	for _, c := range field[:end] {
+		if c < ' ' || c > '~' {
+			return ""
+		}
+	}
+
+	return string(field[:end])
+}
+
+// Bytes returns rdt in the .rdt file format.  The header read by
+// ReadRDT or ParseRDT is reused, so CPS-specific header contents are
+// preserved.  The sizes, model name and the trailer CRC are updated to
+// match rdt.
+func (rdt *RDT) Bytes() []byte {
+	size := len(rdt.Codeplug)
+	total := rdtHeaderSize + size + rdtTrailerSize
+
+	header := rdt.header
+	if len(header) != rdtHeaderSize {
+		header = newRDTHeader()
+	}
+
+	data := make([]byte, 0, total)
+	data = append(data, header...)
+	data = append(data, rdt.Codeplug...)
+	data = append(data, dfuseSuffix(0xffff, 0xdf11, 0x0483)...)
+
+	le := binary.LittleEndian
+	le.PutUint32(data[rdtImageSizeOffset:], uint32(total-rdtTrailerSize))
+	targetSizeOffset := rdtPrefixSize + rdtTargetSize - 8
+	le.PutUint32(data[targetSizeOffset:], uint32(rdtElementSize+rdtCPSBlockSize+size))
+	le.PutUint32(data[rdtElemSizeOffset:], uint32(rdtCPSBlockSize+size))
+
+	model := data[rdtModelOffset : rdtModelOffset+rdtModelSize]
+	for i := range model {
+		model[i] = 0
+	}
+	copy(model, rdt.Model) // silently truncated to rdtModelSize
+
+	le.PutUint32(data[total-4:], dfuseCRC(data[:total-4]))
+
+	return data
+}
+
+// WriteTo writes rdt in the .rdt file format to w.
+func (rdt *RDT) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(rdt.Bytes())
+	return int64(n), err
+}
+
+// newRDTHeader returns the DfuSe prefix, target prefix, element header
+// and an empty CPS block.  The size fields are filled in by Bytes.
+func newRDTHeader() []byte {
+	header := make([]byte, rdtHeaderSize)
+
+	copy(header, "DfuSe")
+	header[5] = 0x01 // bVersion
+	header[10] = 1   // bTargets
+
+	target := header[rdtPrefixSize:]
+	copy(target, "Target")
+	binary.LittleEndian.PutUint32(target[rdtTargetSize-4:], 1) // dwNbElements
+
+	return header
+}
+
+// ReadCodeplugRDT reads a codeplug of size bytes from the radio and
+// writes it to w as an .rdt file naming model.
+func (dfu *Dfu) ReadCodeplugRDT(w io.Writer, model string, size int) error {
+	defer dfu.operation("ReadCodeplugRDT")()
+
+	data := make([]byte, size)
+
+	err := dfu.ReadCodeplug(data)
+	if err != nil {
+		return wrapError("ReadCodeplugRDT", err)
+	}
+
+	rdt := &RDT{
+		Model:    model,
+		Codeplug: data,
+	}
+
+	_, err = rdt.WriteTo(w)
+	if err != nil {
+		return wrapError("ReadCodeplugRDT", err)
+	}
+
+	return nil
+}
+
+// WriteCodeplugRDT writes the codeplug contained in the .rdt file
+// read from rdr to the radio.  Options are as for WriteCodeplug, and
+// the model named in the .rdt header must also match the radio.
+func (dfu *Dfu) WriteCodeplugRDT(rdr io.Reader, opts ...Option) error {
+	defer dfu.operation("WriteCodeplugRDT")()
+
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return wrapError("WriteCodeplugRDT", err)
+	}
+
+	// A signature covers the .rdt file, not the codeplug within it.
+	o := newOptions(opts)
+	err = o.checkFile(data)
+	if err != nil {
+		return err
+	}
+
+	rdt, err := ParseRDT(data)
+	if err != nil {
+		return wrapError("WriteCodeplugRDT", err)
+	}
+
+	err = dfu.writeCodeplug(rdt.Codeplug, rdt.Model, o)
+	if err != nil {
+		switch err.(type) {
+		case *MismatchError, *UnknownModelError, *SignatureError:
+			return err
+		}
+		return wrapError("WriteCodeplugRDT", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package dfu_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// rdtHeaderSize is the size of the .rdt header preceding the codeplug.
+const rdtHeaderSize = 549
+
+func TestParseRDT(t *testing.T) {
+	rdt := &dfu.RDT{Model: "MD380", Codeplug: testCodeplug(1)}
+	file := rdt.Bytes()
+
+	parsed, err := dfu.ParseRDT(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Model != "MD380" || !bytes.Equal(parsed.Codeplug, rdt.Codeplug) {
+		t.Errorf("parsed model %q and a different codeplug", parsed.Model)
+	}
+	if !bytes.Equal(parsed.Bytes(), file) {
+		t.Error("a parsed .rdt file is not written back unchanged")
+	}
+}
+
+func TestParseRDTErrors(t *testing.T) {
+	// modified returns a copy of a valid .rdt file changed by change.
+	modified := func(change func(file []byte) []byte) []byte {
+		rdt := &dfu.RDT{Model: "MD380", Codeplug: testCodeplug(1)}
+		return change(rdt.Bytes())
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"truncated header", modified(func(file []byte) []byte {
+			return file[:rdtHeaderSize-1]
+		})},
+		{"bad DfuSe prefix", modified(func(file []byte) []byte {
+			file[0] = 'd'
+			return fixCRC(file)
+		})},
+		{"bad trailer", modified(func(file []byte) []byte {
+			copy(file[len(file)-8:], "XXX")
+			return fixCRC(file)
+		})},
+		{"bad CRC", modified(func(file []byte) []byte {
+			file[rdtHeaderSize] ^= 0xff
+			return file
+		})},
+		{"codeplug shorter than the header says", modified(func(file []byte) []byte {
+			file = append(file[:rdtHeaderSize+1024], file[rdtHeaderSize+2048:]...)
+			return fixCRC(file)
+		})},
+		{"codeplug not whole blocks", (&dfu.RDT{Model: "MD380", Codeplug: make([]byte, 1000)}).Bytes()},
+		{"no model", (&dfu.RDT{Codeplug: testCodeplug(1)}).Bytes()},
+	}
+
+	for _, test := range tests {
+		_, err := dfu.ParseRDT(test.file)
+		if err == nil {
+			t.Errorf("%s: file accepted", test.name)
+		}
+	}
+}
+
+func TestWriteCodeplugRDT(t *testing.T) {
+	uv380Size := dfu.LookupProfile("UV380").CodeplugSize
+
+	tests := []struct {
+		name     string
+		rdt      *dfu.RDT
+		mismatch bool
+	}{
+		{"matching", &dfu.RDT{Model: "MD380", Codeplug: testCodeplug(1)}, false},
+		{"other model", &dfu.RDT{Model: "MD390", Codeplug: testCodeplug(1)}, true},
+		{"wrong size for the model", &dfu.RDT{Model: "MD380", Codeplug: make([]byte, uv380Size)}, true},
+	}
+
+	for _, test := range tests {
+		radio, d := newRadio(t, nil, nil)
+
+		err := d.WriteCodeplugRDT(bytes.NewReader(test.rdt.Bytes()))
+		if test.mismatch {
+			if _, ok := err.(*dfu.MismatchError); !ok {
+				t.Errorf("%s: got error %v, want a *MismatchError", test.name, err)
+			}
+			if radio.Flash(0, 1)[0] != 0xff {
+				t.Errorf("%s: the radio was written", test.name)
+			}
+			d.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			d.Close()
+			continue
+		}
+
+		var buf bytes.Buffer
+		err = d.ReadCodeplugRDT(&buf, test.rdt.Model, len(test.rdt.Codeplug))
+		d.Close()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), test.rdt.Bytes()) {
+			t.Errorf("%s: the .rdt file read back differs from the one written", test.name)
+		}
+	}
+}
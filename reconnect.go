@@ -0,0 +1,255 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// waitInterval is how often WaitForDevice lists the attached radios.
+const waitInterval = 500 * time.Millisecond
+
+// WaitForDevice waits until exactly one attached radio satisfies
+// match, and returns it.  It fails when ctx is done, or when more than
+// one radio matches.  For example, after asking the operator to start
+// a radio in bootloader mode:
+//
+//	info, err := dfu.WaitForDevice(ctx, func(info *dfu.DeviceInfo) bool {
+//		return info.Bootloader
+//	})
+func WaitForDevice(ctx context.Context, match func(*DeviceInfo) bool) (*DeviceInfo, error) {
+	var found *DeviceInfo
+	err := poll(ctx, func() (bool, error) {
+		infos, err := List()
+		if err != nil {
+			return false, err
+		}
+
+		var matches []*DeviceInfo
+		for _, info := range infos {
+			if match(info) {
+				matches = append(matches, info)
+			}
+		}
+		if len(matches) > 1 {
+			return false, fmt.Errorf("%d radios match", len(matches))
+		}
+		if len(matches) == 1 {
+			found = matches[0]
+			return true, nil
+		}
+
+		return false, nil
+	})
+	if err != nil {
+		return nil, wrapError("WaitForDevice", err)
+	}
+
+	return found, nil
+}
+
+// WaitForDeviceGone waits until no attached radio satisfies match.
+// It fails when ctx is done.
+func WaitForDeviceGone(ctx context.Context, match func(*DeviceInfo) bool) error {
+	err := poll(ctx, func() (bool, error) {
+		infos, err := List()
+		if err != nil {
+			return false, err
+		}
+
+		for _, info := range infos {
+			if match(info) {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return wrapError("WaitForDeviceGone", err)
+	}
+
+	return nil
+}
+
+// poll calls try every waitInterval until it reports done or ctx is
+// done.  Errors from try are retried, since a radio being enumerated
+// may not answer, but the last one is reported if ctx ends first.
+func poll(ctx context.Context, try func() (done bool, err error)) error {
+	var lastErr error
+	for {
+		done, err := try()
+		if done {
+			return nil
+		}
+		if err == errListNotSupported {
+			return err
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		select {
+		case <-time.After(waitInterval):
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("%s: %s", ctx.Err(), lastErr)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// Reconnect waits for the radio to come back in application mode after
+// an operation that restarts it, such as WriteCodeplug, or after the
+// operator restarts it following WriteFirmware.  It closes dfu, reopens
+// the radio and confirms that it is the same radio, by its UniqueID if
+// that was read before the radio restarted, and otherwise by its USB
+// serial number.  A radio in bootloader mode may report a different
+// serial number, so unless its UniqueID is known Reconnect fails.  If
+// the radio returns with firmware that cannot report the UniqueID read
+// in bootloader mode, as stock firmware cannot, its serial number is
+// compared instead.  Reconnect also fails when ctx is done.  On
+// success it returns the reopened radio, which the caller must close.
+//
+// A radio opened by Open with a selector is found again at the same USB
+// path.  Otherwise it is found by serial number, or, in bootloader mode
+// where the serial number differs, as the only radio in application
+// mode.
+func (dfu *Dfu) Reconnect(ctx context.Context) (*Dfu, error) {
+	// A radio left in bootloader mode has not restarted yet, so its
+	// UniqueID may still be read.
+	if dfu.bootloader && dfu.uniqueID == "" {
+		dfu.UniqueID()
+	}
+
+	progressCallback := dfu.progressCallback
+	dfu.Close()
+
+	if dfu.bootloader && dfu.uniqueID == "" {
+		return nil, errors.New("Reconnect: the radio's UniqueID is unknown, so the radio that returns cannot be confirmed")
+	}
+
+	old := dfu.device
+	if old == nil && !dfu.bootloader && dfu.serial == "" {
+		return nil, errors.New("Reconnect: radio has no serial number to find it by")
+	}
+
+	sameSerial := func(info *DeviceInfo) bool {
+		return dfu.serial != "" && info.Serial == dfu.serial
+	}
+
+	// A radio restarted from application mode may still be listed
+	// until it drops off the bus.  Once back, it has a new address.
+	if !dfu.bootloader {
+		gone := sameSerial
+		if old != nil {
+			gone = func(info *DeviceInfo) bool {
+				return info.Bus == old.Bus && info.Address == old.Address
+			}
+		}
+		err := WaitForDeviceGone(ctx, gone)
+		if err != nil {
+			return nil, errors.New("Reconnect: radio did not restart: " + err.Error())
+		}
+	}
+
+	info, err := WaitForDevice(ctx, func(info *DeviceInfo) bool {
+		switch {
+		case info.Bootloader:
+			return false
+		case old != nil:
+			return info.Path == old.Path
+		case !dfu.bootloader:
+			return sameSerial(info)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.New("Reconnect: radio did not return: " + err.Error())
+	}
+
+	newDfu, err := Open(info.Path, progressCallback)
+	if err != nil {
+		return nil, wrapError("Reconnect", err)
+	}
+	newDfu.SetLogger(dfu.logger, dfu.trace)
+
+	err = dfu.checkSameRadio(newDfu)
+	if err != nil {
+		newDfu.Close()
+		return nil, err
+	}
+	newDfu.profile = dfu.profile
+	newDfu.info("radio reconnected", "serial", newDfu.serial)
+
+	return newDfu, nil
+}
+
+// checkSameRadio confirms that newDfu, reopened in application mode,
+// is the radio dfu was opened on.
+func (dfu *Dfu) checkSameRadio(newDfu *Dfu) error {
+	if dfu.uniqueID == "" {
+		if dfu.bootloader {
+			return errors.New("Reconnect: the radio's UniqueID is unknown, so the radio that returned cannot be confirmed")
+		}
+		if dfu.serial != "" && newDfu.serial != dfu.serial {
+			return fmt.Errorf("Reconnect: radio serial %q returned in place of %q", newDfu.serial, dfu.serial)
+		}
+		return nil
+	}
+
+	// A fingerprint is compared with the returned radio's fingerprint,
+	// even if its firmware now reports the MCU's unique device ID.
+	var id string
+	var err error
+	if strings.HasPrefix(dfu.uniqueID, fingerprintPrefix) {
+		_, err = newDfu.init()
+		if err == nil {
+			id, err = newDfu.fingerprint()
+		}
+	} else {
+		id, err = newDfu.UniqueID()
+	}
+	if err != nil {
+		return errors.New("Reconnect: cannot confirm the radio that returned: " + err.Error())
+	}
+	if strings.HasPrefix(id, fingerprintPrefix) && !strings.HasPrefix(dfu.uniqueID, fingerprintPrefix) {
+		// The firmware does not report the MCU's unique device ID,
+		// so the radio is confirmed by its serial number.
+		if dfu.serial == "" || newDfu.serial != dfu.serial {
+			return fmt.Errorf("Reconnect: radio serial %q returned in place of %q, and its firmware does not report the MCU's unique device ID", newDfu.serial, dfu.serial)
+		}
+		return nil
+	}
+	if id != dfu.uniqueID {
+		return fmt.Errorf("Reconnect: radio %s returned in place of %s", id, dfu.uniqueID)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+func TestCheckSameRadio(t *testing.T) {
+	radio := sim.New("MD380")
+	radio.SetUniqueID([]byte("unit-0000001"))
+	other := sim.New("MD380")
+	other.SetUniqueID([]byte("unit-0000002"))
+	stock := sim.New("MD380")
+	stock.SetUniqueID([]byte("unit-0000001"))
+	stock.SetStockFirmware(true)
+	otherStock := sim.New("MD380")
+	otherStock.SetSerial("SIMOTHER")
+	otherStock.SetStockFirmware(true)
+
+	d, err := NewWithTransport(stock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := d.UniqueID()
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		old   *Dfu
+		radio *sim.Radio
+		ok    bool
+	}{
+		{"same", &Dfu{bootloader: true, uniqueID: "uid:756e69742d30303030303031"}, radio, true},
+		{"other", &Dfu{bootloader: true, uniqueID: "uid:756e69742d30303030303031"}, other, false},
+		{"stock firmware after bootloader", &Dfu{bootloader: true, serial: "SIMMD380", uniqueID: "uid:756e69742d30303030303031"}, stock, true},
+		{"other stock firmware after bootloader", &Dfu{bootloader: true, serial: "SIMMD380", uniqueID: "uid:756e69742d30303030303031"}, otherStock, false},
+		{"stock firmware after bootloader without serial", &Dfu{bootloader: true, uniqueID: "uid:756e69742d30303030303031"}, stock, false},
+		{"same fingerprint", &Dfu{uniqueID: fp}, stock, true},
+		{"other fingerprint", &Dfu{uniqueID: fp}, otherStock, false},
+		{"bootloader without ID", &Dfu{bootloader: true}, radio, false},
+		{"same serial without ID", &Dfu{serial: "SIMMD380"}, radio, true},
+		{"other serial without ID", &Dfu{serial: "SIMUV380"}, radio, false},
+	}
+
+	for _, test := range tests {
+		newDfu, err := NewWithTransport(test.radio, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = test.old.checkSameRadio(newDfu)
+		newDfu.Close()
+
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: different or unconfirmed radio accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// JobState is the state of a job.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCanceled  JobState = "canceled"
+)
+
+func (state JobState) finished() bool {
+	return state == JobSucceeded || state == JobFailed || state == JobCanceled
+}
+
+var errCanceled = errors.New("canceled")
+
+// Job is an operation queued for a device.
+type Job struct {
+	mu sync.Mutex
+
+	id       string
+	device   string
+	op       string
+	state    JobState
+	progress int // percent complete of the current phase
+	err      error
+	result   interface{}
+	data     []byte // the result of a read, for download
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	cancel   bool
+
+	run      func(d *dfu.Dfu) (result interface{}, data []byte, err error)
+	watchers map[chan struct{}]bool
+}
+
+// JobStatus is a snapshot of a job, as reported by the API.
+type JobStatus struct {
+	ID       string      `json:"id"`
+	Device   string      `json:"device"`
+	Op       string      `json:"op"`
+	State    JobState    `json:"state"`
+	Progress int         `json:"progress"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	HasData  bool        `json:"hasData,omitempty"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// Status returns a snapshot of the job.
+func (job *Job) Status() *JobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	status := &JobStatus{
+		ID:       job.id,
+		Device:   job.device,
+		Op:       job.op,
+		State:    job.state,
+		Progress: job.progress,
+		Result:   job.result,
+		HasData:  job.data != nil,
+		Created:  job.created,
+	}
+	if job.err != nil {
+		status.Error = job.err.Error()
+	}
+	if !job.started.IsZero() {
+		started := job.started
+		status.Started = &started
+	}
+	if !job.finished.IsZero() {
+		finished := job.finished
+		status.Finished = &finished
+	}
+
+	return status
+}
+
+// Cancel cancels the job.  A queued job will not be run, and a running
+// job is stopped at its next progress report.  A cancelled codeplug
+// write restores the original codeplug before it stops.
+func (job *Job) Cancel() {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.cancel = true
+	if job.state == JobQueued {
+		job.setState(JobCanceled)
+	}
+}
+
+// watch returns a channel that receives a value whenever the job
+// changes, and a function to stop watching.  Changes may be coalesced.
+func (job *Job) watch() (<-chan struct{}, func()) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	job.watchers[ch] = true
+
+	return ch, func() {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+
+		delete(job.watchers, ch)
+	}
+}
+
+// notify tells the watchers that the job has changed.  The caller
+// holds job.mu.
+func (job *Job) notify() {
+	for ch := range job.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setState changes the job's state.  The caller holds job.mu.
+func (job *Job) setState(state JobState) {
+	job.state = state
+	switch {
+	case state == JobRunning:
+		job.started = time.Now()
+	case state.finished():
+		job.finished = time.Now()
+	}
+	job.notify()
+}
+
+// progressCallback is the dfu progress callback for the job.
+func (job *Job) progressCallback(progressCounter int) error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.cancel {
+		return errCanceled
+	}
+
+	percent := progressCounter * 100 / dfu.MaxProgress
+	if percent > 100 {
+		percent = 100
+	}
+	if percent != job.progress {
+		job.progress = percent
+		job.notify()
+	}
+
+	return nil
+}
+
+// execute runs the job on the device opened by open.
+func (job *Job) execute(open Opener) {
+	job.mu.Lock()
+	if job.state != JobQueued {
+		job.mu.Unlock()
+		return
+	}
+	job.setState(JobRunning)
+	job.mu.Unlock()
+
+	var result interface{}
+	var data []byte
+	d, err := open(job.progressCallback)
+	if err == nil {
+		result, data, err = job.run(d)
+		d.Close()
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.result = result
+	job.data = data
+	job.err = err
+	switch {
+	case err == nil:
+		job.progress = 100
+		job.setState(JobSucceeded)
+	case job.cancel:
+		job.setState(JobCanceled)
+	default:
+		job.setState(JobFailed)
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package server provides an HTTP API for programming radios attached
+// to the host, so that they may be programmed from other machines.
+//
+// Jobs are queued per device and run one at a time.  The API is:
+//
+//	GET    /devices                      list the devices
+//	POST   /devices/{name}/info          queue a job reading the radio's RadioInfo
+//	POST   /devices/{name}/codeplug/read queue a job reading the codeplug
+//	POST   /devices/{name}/codeplug      queue a job writing the codeplug in the body
+//	POST   /devices/{name}/users/read    queue a job reading the users image
+//	POST   /devices/{name}/users         queue a job writing the users image in the body
+//	POST   /devices/{name}/firmware      queue a job writing the firmware in the body
+//	GET    /jobs/{id}                    get a job's status
+//	GET    /jobs/{id}/events             stream a job's progress as server-sent events
+//	GET    /jobs/{id}/data               get the data read by a job
+//	DELETE /jobs/{id}                    cancel a job
+//
+// The write requests accept the query parameters force=true, for the
+// dfu.Force option, and model=<model>, for dfu.Model.  Their results
+// report the size and SHA-256 hash of the image written.  Users images
+// may be read only from radios using the dfu.MD380Users format.
+// Finished jobs are forgotten after the Server's JobRetention.
+// Queued jobs are reported with status 202 and the job's status as
+// JSON.  Errors are reported as JSON objects with an "error" member.
+//
+// Codeplugs are written with dfu.WriteCodeplugAtomic, so a codeplug
+// write that fails or is cancelled restores the radio's original
+// codeplug.  Its result's "codeplug" member reports the state the
+// radio was left in.
+//
+// The events stream sends a "progress" event, with the job's status as
+// data, as the job progresses, and ends with a "done" event.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+)
+
+// Opener opens a device, arranging for progress to be reported to
+// progressCallback, as dfu.New does.
+type Opener func(progressCallback func(progressCounter int) error) (*dfu.Dfu, error)
+
+// MaxUploadSize limits the size of request bodies.
+const MaxUploadSize = 32 * 1024 * 1024
+
+// queueSize limits the number of jobs waiting for each device.
+const queueSize = 64
+
+// DefaultJobRetention is how long finished jobs are kept, unless the
+// Server's JobRetention says otherwise.
+const DefaultJobRetention = time.Hour
+
+type device struct {
+	name  string
+	open  Opener
+	queue chan *Job
+}
+
+// Server serves the API for a set of devices.
+type Server struct {
+	// JobRetention is how long a finished job, with any data it read,
+	// is kept for its client to collect.  If zero,
+	// DefaultJobRetention is used.
+	JobRetention time.Duration
+
+	mu      sync.Mutex
+	devices map[string]*device
+	jobs    map[string]*Job
+	nextID  int
+}
+
+// New returns a server for the named devices.  Each device's jobs are
+// run by a goroutine of its own.
+func New(devices map[string]Opener) *Server {
+	s := &Server{
+		devices: make(map[string]*device),
+		jobs:    make(map[string]*Job),
+	}
+
+	for name, open := range devices {
+		dev := &device{
+			name:  name,
+			open:  open,
+			queue: make(chan *Job, queueSize),
+		}
+		s.devices[name] = dev
+
+		go func() {
+			for job := range dev.queue {
+				job.execute(dev.open)
+			}
+		}()
+	}
+
+	return s
+}
+
+// Close stops the server's goroutines once the queued jobs have run.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, dev := range s.devices {
+		close(dev.queue)
+	}
+	s.devices = nil
+}
+
+// Job returns the job with the given id, or nil.
+func (s *Server) Job(id string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.jobs[id]
+}
+
+// Submit queues a job running op on the named device.
+func (s *Server) Submit(name, op string, run func(d *dfu.Dfu) (interface{}, []byte, error)) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dev := s.devices[name]
+	if dev == nil {
+		return nil, fmt.Errorf("no device %q", name)
+	}
+
+	s.expireJobs()
+
+	s.nextID++
+	job := &Job{
+		id:       strconv.Itoa(s.nextID),
+		device:   name,
+		op:       op,
+		state:    JobQueued,
+		created:  time.Now(),
+		run:      run,
+		watchers: make(map[chan struct{}]bool),
+	}
+
+	select {
+	case dev.queue <- job:
+	default:
+		return nil, fmt.Errorf("device %q has too many queued jobs", name)
+	}
+	s.jobs[job.id] = job
+
+	return job, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(path) == 1 && path[0] == "devices" && r.Method == http.MethodGet:
+		s.listDevices(w, r)
+	case len(path) >= 3 && path[0] == "devices" && r.Method == http.MethodPost:
+		s.submit(w, r, path[1], strings.Join(path[2:], "/"))
+	case len(path) >= 2 && path[0] == "jobs":
+		job := s.Job(path[1])
+		if job == nil {
+			writeError(w, http.StatusNotFound, errors.New("no such job"))
+			return
+		}
+		op := strings.Join(path[2:], "/")
+		switch {
+		case op == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, job.Status())
+		case op == "" && r.Method == http.MethodDelete:
+			job.Cancel()
+			writeJSON(w, http.StatusOK, job.Status())
+		case op == "events" && r.Method == http.MethodGet:
+			serveEvents(w, r, job)
+		case op == "data" && r.Method == http.MethodGet:
+			serveData(w, job)
+		default:
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// expireJobs forgets the jobs that finished more than JobRetention
+// ago.  The caller holds s.mu.
+func (s *Server) expireJobs() {
+	retention := s.JobRetention
+	if retention == 0 {
+		retention = DefaultJobRetention
+	}
+
+	for id, job := range s.jobs {
+		job.mu.Lock()
+		expired := job.state.finished() && time.Since(job.finished) > retention
+		job.mu.Unlock()
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+type deviceStatus struct {
+	Name   string `json:"name"`
+	Queued int    `json:"queued"`
+}
+
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	var devices []deviceStatus
+	for _, dev := range s.devices {
+		devices = append(devices, deviceStatus{dev.name, len(dev.queue)})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// writeResult reports a write.
+type writeResult struct {
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Codeplug string `json:"codeplug,omitempty"` // the dfu.CodeplugState, for codeplug writes
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request, name, op string) {
+	var body []byte
+	if op != "info" && op != "codeplug/read" && op != "users/read" {
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxUploadSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(body) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("empty request body"))
+			return
+		}
+	}
+
+	var opts []dfu.Option
+	if r.URL.Query().Get("force") == "true" {
+		opts = append(opts, dfu.Force())
+	}
+	if model := r.URL.Query().Get("model"); model != "" {
+		opts = append(opts, dfu.Model(model))
+	}
+
+	var result dfu.Result
+	opts = append(opts, dfu.Report(&result))
+	written := func(err error) (interface{}, []byte, error) {
+		if err != nil {
+			return nil, nil, err
+		}
+		return &writeResult{Size: len(body), SHA256: result.SHA256}, nil, nil
+	}
+
+	var run func(d *dfu.Dfu) (interface{}, []byte, error)
+	switch op {
+	case "info":
+		run = func(d *dfu.Dfu) (interface{}, []byte, error) {
+			info, err := d.RadioInfo()
+			return info, nil, err
+		}
+	case "codeplug/read":
+		run = func(d *dfu.Dfu) (interface{}, []byte, error) {
+			var buf bytes.Buffer
+			_, err := d.ReadCodeplugAuto(&buf)
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, buf.Bytes(), nil
+		}
+	case "codeplug":
+		run = func(d *dfu.Dfu) (interface{}, []byte, error) {
+			state, err := d.WriteCodeplugAtomic(body, opts...)
+			r := &writeResult{Size: len(body), SHA256: result.SHA256, Codeplug: state.String()}
+			return r, nil, err
+		}
+	case "users/read":
+		run = func(d *dfu.Dfu) (interface{}, []byte, error) {
+			profile, err := d.Profile()
+			if err != nil {
+				return nil, nil, err
+			}
+			if profile.UsersFormat != dfu.MD380Users {
+				return nil, nil, fmt.Errorf("users/read: not supported for %s radios", profile.Name)
+			}
+			var buf bytes.Buffer
+			err = d.ReadMD380Users(&buf)
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, buf.Bytes(), nil
+		}
+	case "users":
+		run = func(d *dfu.Dfu) (interface{}, []byte, error) {
+			return written(d.WriteRawUsers(bytes.NewReader(body), len(body), opts...))
+		}
+	case "firmware":
+		run = func(d *dfu.Dfu) (interface{}, []byte, error) {
+			return written(d.WriteFirmware(bytes.NewReader(body), opts...))
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	job, err := s.Submit(name, op, run)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.id)
+	writeJSON(w, http.StatusAccepted, job.Status())
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	changed, stop := job.watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var last *JobStatus
+	for {
+		status := job.Status()
+		event := "progress"
+		if status.State.finished() {
+			event = "done"
+		}
+
+		if last == nil || status.State != last.State || status.Progress != last.Progress {
+			data, _ := json.Marshal(status)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			flusher.Flush()
+		}
+		if event == "done" {
+			return
+		}
+		last = status
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func serveData(w http.ResponseWriter, job *Job) {
+	job.mu.Lock()
+	data := job.data
+	job.mu.Unlock()
+
+	if data == nil {
+		writeError(w, http.StatusNotFound, errors.New("job has no data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,354 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/server"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// newTestServer serves a simulated MD380 as device "sim".  The
+// returned function stops the server.
+func newTestServer() (*httptest.Server, *sim.Radio, func()) {
+	radio := sim.New("MD380")
+	s := server.New(map[string]server.Opener{
+		"sim": func(progressCallback func(int) error) (*dfu.Dfu, error) {
+			return dfu.NewWithTransport(radio, progressCallback)
+		},
+	})
+	ts := httptest.NewServer(s)
+
+	return ts, radio, func() {
+		ts.Close()
+		s.Close()
+	}
+}
+
+func post(t *testing.T, url string, body []byte) *server.JobStatus {
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("POST %s: %s: %s", url, resp.Status, msg)
+	}
+
+	var status server.JobStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &status
+}
+
+func waitJob(t *testing.T, base, id string) *server.JobStatus {
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(base + "/jobs/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status server.JobStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch status.State {
+		case server.JobSucceeded, server.JobFailed, server.JobCanceled:
+			return &status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s did not finish", id)
+	return nil
+}
+
+func testCodeplug(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i>>10)
+	}
+
+	return data
+}
+
+func TestWriteAndReadCodeplug(t *testing.T) {
+	ts, radio, stop := newTestServer()
+	defer stop()
+
+	data := testCodeplug(dfu.LookupProfile("MD380").CodeplugSize)
+	job := post(t, ts.URL+"/devices/sim/codeplug", data)
+	status := waitJob(t, ts.URL, job.ID)
+	if status.State != server.JobSucceeded {
+		t.Fatalf("write: %s: %s", status.State, status.Error)
+	}
+	if !bytes.Equal(radio.Flash(0, len(data)), data) {
+		t.Fatal("write: radio's codeplug differs from the one written")
+	}
+
+	job = post(t, ts.URL+"/devices/sim/codeplug/read", nil)
+	status = waitJob(t, ts.URL, job.ID)
+	if status.State != server.JobSucceeded || !status.HasData {
+		t.Fatalf("read: %s: %s", status.State, status.Error)
+	}
+
+	resp, err := http.Get(ts.URL + "/jobs/" + job.ID + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read: got %d bytes differing from the %d written", len(got), len(data))
+	}
+}
+
+func TestWriteAndReadUsers(t *testing.T) {
+	ts, radio, stop := newTestServer()
+	defer stop()
+
+	users := "3100001,N0CALL,Test User,Mesa,Arizona,,United States\n"
+	data := []byte(strconv.Itoa(len(users)) + "\n" + users)
+	job := post(t, ts.URL+"/devices/sim/users", data)
+	status := waitJob(t, ts.URL, job.ID)
+	if status.State != server.JobSucceeded {
+		t.Fatalf("write: %s: %s", status.State, status.Error)
+	}
+	if !bytes.Equal(radio.SPIFlash(0x100000, len(data)), data) {
+		t.Fatal("write: radio's users image differs from the one written")
+	}
+	sum := sha256.Sum256(data)
+	result, _ := status.Result.(map[string]interface{})
+	if result["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("write: result %v does not report the image's SHA-256", status.Result)
+	}
+
+	job = post(t, ts.URL+"/devices/sim/users/read", nil)
+	status = waitJob(t, ts.URL, job.ID)
+	if status.State != server.JobSucceeded || !status.HasData {
+		t.Fatalf("read: %s: %s", status.State, status.Error)
+	}
+
+	resp, err := http.Get(ts.URL + "/jobs/" + job.ID + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read: got %q, want %q", got, data)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ts, _, stop := newTestServer()
+	defer stop()
+
+	job := post(t, ts.URL+"/devices/sim/info", nil)
+
+	resp, err := http.Get(ts.URL + "/jobs/" + job.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type is %q", ct)
+	}
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			event = strings.TrimPrefix(line, "event: ")
+			continue
+		}
+		if event == "done" && strings.HasPrefix(line, "data: ") {
+			var status server.JobStatus
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.State != server.JobSucceeded {
+				t.Fatalf("info: %s: %s", status.State, status.Error)
+			}
+			return
+		}
+	}
+
+	t.Fatal("stream ended without a done event")
+}
+
+func TestCodeplugSizeMismatch(t *testing.T) {
+	ts, _, stop := newTestServer()
+	defer stop()
+
+	job := post(t, ts.URL+"/devices/sim/codeplug", make([]byte, 1024))
+	status := waitJob(t, ts.URL, job.ID)
+	if status.State != server.JobFailed {
+		t.Fatalf("wrong size codeplug: %s, want failed", status.State)
+	}
+}
+
+func TestUnknownJob(t *testing.T) {
+	ts, _, stop := newTestServer()
+	defer stop()
+
+	resp, err := http.Get(ts.URL + "/jobs/999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %s, want 404", resp.Status)
+	}
+}
+
+func TestCancelCodeplugWrite(t *testing.T) {
+	size := dfu.LookupProfile("MD380").CodeplugSize
+	original := testCodeplug(size)
+
+	radio := sim.New("MD380")
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.WriteCodeplug(original)
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The write pauses once it has begun erasing, until it is
+	// cancelled, as the simulated radio would otherwise finish first.
+	erasing := make(chan struct{})
+	resume := make(chan struct{})
+	s := server.New(map[string]server.Opener{
+		"sim": func(progressCallback func(int) error) (*dfu.Dfu, error) {
+			paused := false
+			return dfu.NewWithTransport(radio, func(progressCounter int) error {
+				if !paused && radio.Flash(0, 1)[0] != original[0] {
+					paused = true
+					close(erasing)
+					<-resume
+				}
+				return progressCallback(progressCounter)
+			})
+		},
+	})
+	ts := httptest.NewServer(s)
+	defer func() {
+		ts.Close()
+		s.Close()
+	}()
+
+	job := post(t, ts.URL+"/devices/sim/codeplug", bytes.Repeat([]byte{0x55}, size))
+	select {
+	case <-erasing:
+	case <-time.After(time.Minute):
+		t.Fatal("write did not start erasing")
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/jobs/"+job.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	close(resume)
+
+	status := waitJob(t, ts.URL, job.ID)
+	if status.State != server.JobCanceled {
+		t.Fatalf("cancelled write: %s: %s", status.State, status.Error)
+	}
+	result, _ := status.Result.(map[string]interface{})
+	if result["codeplug"] != dfu.CodeplugRestored.String() {
+		t.Errorf("cancelled write left codeplug %v, want %s", result["codeplug"], dfu.CodeplugRestored)
+	}
+	if !bytes.Equal(radio.Flash(0, size), original) {
+		t.Error("cancelled write did not restore the original codeplug")
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+	radio := sim.New("MD380")
+	s := server.New(map[string]server.Opener{
+		"sim": func(progressCallback func(int) error) (*dfu.Dfu, error) {
+			return dfu.NewWithTransport(radio, progressCallback)
+		},
+	})
+	defer s.Close()
+	s.JobRetention = time.Millisecond
+
+	run := func(d *dfu.Dfu) (interface{}, []byte, error) {
+		return nil, nil, nil
+	}
+
+	first, err := s.Submit("sim", "test", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for first.Status().Finished == nil {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = s.Submit("sim", "test", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Job(first.Status().ID) != nil {
+		t.Error("finished job was kept after its retention")
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A detached signature file is text:
+//
+//	dfu-signature-v1
+//	signer: <name>
+//	signature: <base64 ed25519 signature>
+//
+// The signature covers signatureContext, the signer's name, a zero
+// byte and the SHA-256 hash of the signed file, so a signature cannot
+// be relabeled with another signer's name.
+const (
+	signatureMagic   = "dfu-signature-v1"
+	signatureContext = "dfu-signature-v1\x00"
+)
+
+// Signature is a detached signature of a firmware or codeplug file.
+type Signature struct {
+	Signer    string // the name of the signer, as known to a KeyRing
+	Signature []byte // the ed25519 signature
+}
+
+// KeyRing maps signer names to their trusted public keys.
+type KeyRing map[string]ed25519.PublicKey
+
+// SignatureError is returned when a file's signature is missing,
+// malformed or not from a trusted key.
+type SignatureError struct {
+	Signer string
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	if e.Signer == "" {
+		return "signature check failed: " + e.Reason
+	}
+	return fmt.Sprintf("signature check failed for signer %q: %s", e.Signer, e.Reason)
+}
+
+// signedMessage returns the message signed for data by signer.
+func signedMessage(data []byte, signer string) []byte {
+	sum := sha256.Sum256(data)
+
+	msg := []byte(signatureContext)
+	msg = append(msg, signer...)
+	msg = append(msg, 0)
+	msg = append(msg, sum[:]...)
+
+	return msg
+}
+
+// Sign returns signer's detached signature of data.
+func Sign(data []byte, signer string, key ed25519.PrivateKey) *Signature {
+	return &Signature{
+		Signer:    signer,
+		Signature: ed25519.Sign(key, signedMessage(data, signer)),
+	}
+}
+
+// ParseSignature parses a detached signature file.
+func ParseSignature(text []byte) (*Signature, error) {
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+	if len(lines) != 3 || strings.TrimSpace(lines[0]) != signatureMagic {
+		return nil, errors.New("ParseSignature: not a signature file")
+	}
+
+	sig := &Signature{}
+	for _, line := range lines[1:] {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("ParseSignature: bad line %q", line)
+		}
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch line[:colon] {
+		case "signer":
+			sig.Signer = value
+		case "signature":
+			b, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, wrapError("ParseSignature", err)
+			}
+			sig.Signature = b
+		default:
+			return nil, fmt.Errorf("ParseSignature: unknown field %q", line[:colon])
+		}
+	}
+
+	if sig.Signer == "" || len(sig.Signature) != ed25519.SignatureSize {
+		return nil, errors.New("ParseSignature: missing signer or signature")
+	}
+
+	return sig, nil
+}
+
+// Bytes returns sig in the detached signature file format.
+func (sig *Signature) Bytes() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s\n", signatureMagic)
+	fmt.Fprintf(&buf, "signer: %s\n", sig.Signer)
+	fmt.Fprintf(&buf, "signature: %s\n", base64.StdEncoding.EncodeToString(sig.Signature))
+
+	return buf.Bytes()
+}
+
+// Verify checks that sig is a valid signature of data by a key in
+// keys.  It returns a *SignatureError if not.
+func (keys KeyRing) Verify(data []byte, sig *Signature) error {
+	if sig == nil {
+		return &SignatureError{Reason: "no signature"}
+	}
+
+	key, ok := keys[sig.Signer]
+	if !ok || len(key) != ed25519.PublicKeySize {
+		return &SignatureError{
+			Signer: sig.Signer,
+			Reason: "signer is not trusted",
+		}
+	}
+
+	if !ed25519.Verify(key, signedMessage(data, sig.Signer), sig.Signature) {
+		return &SignatureError{
+			Signer: sig.Signer,
+			Reason: "signature does not match",
+		}
+	}
+
+	return nil
+}
+
+// ParseKeyRing parses a key ring file.  Each line holds a signer's name
+// and, after a colon, the signer's base64 ed25519 public key:
+//
+//	release: <base64 ed25519 public key>
+//
+// Blank lines and lines starting with '#' are ignored.
+func ParseKeyRing(text []byte) (KeyRing, error) {
+	keys := make(KeyRing)
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("ParseKeyRing: bad line %q", line)
+		}
+		signer := strings.TrimSpace(line[:colon])
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[colon+1:]))
+		if err != nil {
+			return nil, wrapError("ParseKeyRing", err)
+		}
+		if signer == "" || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ParseKeyRing: bad key for signer %q", signer)
+		}
+
+		keys[signer] = ed25519.PublicKey(key)
+	}
+
+	return keys, nil
+}
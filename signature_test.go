@@ -0,0 +1,112 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+func TestRequireSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testCodeplug(0)
+	keys := dfu.KeyRing{"release": pub}
+
+	tests := []struct {
+		name string
+		sig  *dfu.Signature
+		keys dfu.KeyRing
+	}{
+		{"nil keys", dfu.Sign(data, "release", priv), nil},
+		{"empty keys", dfu.Sign(data, "release", priv), dfu.KeyRing{}},
+		{"nil signature", nil, keys},
+		{"untrusted signer", dfu.Sign(data, "other", otherPriv), keys},
+		{"wrong key", dfu.Sign(data, "release", otherPriv), keys},
+		{"other data", dfu.Sign(testCodeplug(1), "release", priv), keys},
+	}
+
+	for _, test := range tests {
+		radio := sim.New("MD380")
+		d, err := dfu.NewWithTransport(radio, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.WriteCodeplug(data, dfu.RequireSignature(test.sig, test.keys))
+		d.Close()
+		if _, ok := err.(*dfu.SignatureError); !ok {
+			t.Errorf("%s: got error %v, want a *SignatureError", test.name, err)
+		}
+		if radio.Flash(0, 1)[0] != 0xff {
+			t.Errorf("%s: the radio was written", test.name)
+		}
+	}
+
+	err = keys.Verify(data, dfu.Sign(data, "release", priv))
+	if err != nil {
+		t.Errorf("valid signature: %s", err)
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(pub)
+
+	keys, err := dfu.ParseKeyRing([]byte("# release keys\n\nrelease: " + encoded + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys["release"], pub) {
+		t.Errorf("got key ring %v, want the release key", keys)
+	}
+
+	bad := []string{
+		"release " + encoded,
+		": " + encoded,
+		"release: " + encoded[:8],
+		"release: not base64!",
+	}
+	for _, text := range bad {
+		_, err := dfu.ParseKeyRing([]byte(text))
+		if err == nil {
+			t.Errorf("ParseKeyRing(%q) succeeded", text)
+		}
+	}
+}
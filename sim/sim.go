@@ -0,0 +1,581 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sim simulates a TYT MD-380 family radio, for exercising
+// programs that use the dfu package without a radio attached.
+//
+// A Radio implements dfu.Transport, so a Dfu for it is obtained with
+//
+//	d, err := dfu.NewWithTransport(sim.New("MD380"), progressCallback)
+//
+// The simulation follows the requests made by the dfu package rather
+// than the full behavior of a radio.  A Radio implements dfu.Simulator,
+// so the delays the dfu package allows a real radio, such as those
+// after SPI flash erases, are skipped.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/stdfu"
+)
+
+const (
+	controlBlock = 0
+	spiBlock     = 1
+	flashBlock   = 2
+	blockSize    = 1024
+	pageSize     = 1024
+)
+
+const (
+	bootloaderManufacturer = "AnyRoad Technology"
+	appManufacturer        = "TYT"
+	internalFlashLayout    = "@Internal Flash  /0x08000000/03*016Ka,01*016Kg,01*064Kg,07*128Kg"
+	internalFlashString    = 4 // the index of the internal flash interface string
+	uniqueIDAddress        = 0x1fff7a10
+	optionBytesAddress     = 0x1fffc000
+	optionBytesSize        = 16
+	optionBytesAlt         = 1
+	internalFlashBase      = 0x08000000
+	internalFlashEnd       = 0x08100000
+	codeplugEraseSize      = 64 * 1024
+	spiEraseSize           = 64 * 1024
+)
+
+// The simulated SPI flash is a 16MB W25Q128FV.
+var spiFlashJEDEC = []byte{0xef, 0x40, 0x18}
+
+// Radio is a simulated radio.  Its methods may be called concurrently.
+type Radio struct {
+	mu sync.Mutex
+
+	model      string
+	serial     string
+	bootloader bool
+	stock      bool   // the firmware cannot peek at memory
+	protected  bool   // the bootloader refuses to read memory
+	layout     string // the internal flash interface string
+
+	state    stdfu.State
+	alt      int    // the selected interface alternate setting
+	address  int    // the DfuSe address pointer
+	command  []byte // the reply to the next control block upload
+	spiRead  int    // the address of the next SPI flash upload
+	jedec    bool   // the next SPI flash upload returns the JEDEC ID
+	peek     bool   // the next SPI flash upload returns memory at address
+	setTime  bool   // the next control block download is the time
+	time     time.Time
+	reboots  int
+	corrupt  int    // the flash address CorruptNextWrite spoils, or -1
+	flash    memory // codeplug and users flash, in application mode
+	spiFlash memory
+	internal memory // MCU memory, in bootloader mode
+}
+
+// New returns a simulated radio of the named model, in application
+// mode, with erased flash.
+func New(model string) *Radio {
+	r := &Radio{
+		model:    model,
+		serial:   "SIM" + model,
+		layout:   internalFlashLayout,
+		state:    stdfu.DfuIdle,
+		corrupt:  -1,
+		flash:    memory{},
+		spiFlash: memory{},
+		internal: memory{},
+	}
+
+	uid := []byte("SIM-" + model + "\x00\x00\x00\x00\x00\x00\x00\x00")
+	r.internal.write(uniqueIDAddress, uid[:12])
+
+	return r
+}
+
+// SetSerial sets the radio's USB serial number.
+func (r *Radio) SetSerial(serial string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.serial = serial
+}
+
+// SetUniqueID sets the MCU's 96-bit unique device ID.
+func (r *Radio) SetUniqueID(uid []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.internal.write(uniqueIDAddress, uid[:12])
+}
+
+// SetOptionBytes sets the MCU's option bytes, which the bootloader
+// reads through alternate setting 1.
+func (r *Radio) SetOptionBytes(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.internal.write(optionBytesAddress, data[:optionBytesSize])
+}
+
+// SetBootloader simulates turning the radio on in bootloader mode, if
+// bootloader is true, or normally.
+func (r *Radio) SetBootloader(bootloader bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.bootloader = bootloader
+	r.reset()
+}
+
+// SetStockFirmware simulates firmware not patched by md380tools, if
+// stock is true.  Such firmware ignores the address set before an SPI
+// flash upload, so it cannot be used to peek at memory.
+func (r *Radio) SetStockFirmware(stock bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stock = stock
+}
+
+// SetReadProtected simulates a bootloader with flash read protection
+// enabled, if protected is true.  Such a bootloader refuses to read any
+// memory.
+func (r *Radio) SetReadProtected(protected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.protected = protected
+}
+
+// SetInternalFlashLayout sets the interface string in which the
+// bootloader describes its internal flash.
+func (r *Radio) SetInternalFlashLayout(layout string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.layout = layout
+}
+
+// CorruptNextWrite arranges for the next codeplug flash write covering
+// address to store the complement of the byte written there, as a
+// failing flash would.
+func (r *Radio) CorruptNextWrite(address int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.corrupt = address
+}
+
+// Flash returns size bytes of the radio's codeplug flash at address.
+func (r *Radio) Flash(address, size int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]byte, size)
+	r.flash.read(address, data)
+
+	return data
+}
+
+// SPIFlash returns size bytes of the radio's SPI flash at address.
+func (r *Radio) SPIFlash(address, size int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]byte, size)
+	r.spiFlash.read(address, data)
+
+	return data
+}
+
+// InternalFlash returns size bytes of the MCU's memory at address, as
+// written in bootloader mode.
+func (r *Radio) InternalFlash(address, size int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]byte, size)
+	r.internal.read(address, data)
+
+	return data
+}
+
+// Time returns the time last set on the radio's clock.
+func (r *Radio) Time() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.time
+}
+
+// Reboots returns the number of times the radio has been rebooted.
+func (r *Radio) Reboots() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reboots
+}
+
+func (r *Radio) reset() {
+	r.state = stdfu.DfuIdle
+	r.alt = 0
+	r.address = 0
+	r.command = nil
+	r.jedec = false
+	r.peek = false
+	r.setTime = false
+}
+
+// Close implements dfu.Transport.  The radio keeps its contents and
+// may be used again.
+func (r *Radio) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reset()
+}
+
+// Detach implements dfu.Transport.
+func (r *Radio) Detach() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = stdfu.DfuIdle
+
+	return nil
+}
+
+// GetStatus implements dfu.Transport.
+func (r *Radio) GetStatus() (stdfu.DfuStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return stdfu.DfuStatus{State: r.state}, nil
+}
+
+// GetState implements dfu.Transport.
+func (r *Radio) GetState() (stdfu.State, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state, nil
+}
+
+// ClrStatus implements dfu.Transport.
+func (r *Radio) ClrStatus() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = stdfu.DfuIdle
+
+	return nil
+}
+
+// Abort implements dfu.Transport.
+func (r *Radio) Abort() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = stdfu.DfuIdle
+
+	return nil
+}
+
+// GetStringDescriptor implements dfu.Transport.
+func (r *Radio) GetStringDescriptor(index int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case index == 1 && r.bootloader:
+		return bootloaderManufacturer, nil
+	case index == 1:
+		return appManufacturer, nil
+	case index == 3:
+		return r.serial, nil
+	case index == internalFlashString && r.bootloader:
+		return r.layout, nil
+	}
+
+	return "", fmt.Errorf("no string descriptor %d", index)
+}
+
+// Simulated implements dfu.Simulator, as the radio needs no time to
+// carry out a request.
+func (r *Radio) Simulated() bool {
+	return true
+}
+
+// InterfaceDescription implements dfu.InterfaceDescriber.
+func (r *Radio) InterfaceDescription(iface, altSetting int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if iface == 0 && altSetting == 0 && r.bootloader {
+		return r.layout, nil
+	}
+
+	return "", nil
+}
+
+// SelectCurrentConfiguration implements dfu.Transport.
+func (r *Radio) SelectCurrentConfiguration(config, iface, altSetting int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.alt = altSetting
+
+	return nil
+}
+
+// Dnload implements dfu.Transport.
+func (r *Radio) Dnload(block int, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == stdfu.DfuError {
+		return errors.New("sim: Dnload: device is in the error state")
+	}
+
+	var err error
+	switch {
+	case block == controlBlock:
+		err = r.control(data)
+	case block == spiBlock && !r.bootloader:
+		err = r.spi(data)
+	case block >= flashBlock && len(data) == 0:
+		r.reset() // manifestation, the device restarts
+		r.reboots++
+		return nil
+	case block >= flashBlock:
+		address := r.address + (block-flashBlock)*blockSize
+		if r.bootloader {
+			r.internal.write(address, data)
+			break
+		}
+		if r.corrupt >= address && r.corrupt < address+len(data) {
+			data = append([]byte(nil), data...)
+			data[r.corrupt-address] ^= 0xff
+			r.corrupt = -1
+		}
+		r.flash.write(address, data)
+	default:
+		err = fmt.Errorf("Dnload: bad block %d", block)
+	}
+	if err != nil {
+		return r.fail(err.Error())
+	}
+
+	r.state = stdfu.DfuWriteIdle
+
+	return nil
+}
+
+// control handles a download to the control block.
+func (r *Radio) control(data []byte) error {
+	if r.setTime && len(data) == 8 && data[0] == 0xb5 {
+		r.setTime = false
+		r.time = fromBCD(data[1:])
+		return nil
+	}
+
+	switch {
+	case len(data) == 2 && data[0] == 0x91:
+		switch data[1] {
+		case 0x02:
+			r.setTime = true
+		case 0x05:
+			r.reset()
+			r.reboots++
+		}
+	case len(data) == 2 && data[0] == 0xa2:
+		if data[1] == 0x01 {
+			r.command = make([]byte, 32)
+			copy(r.command, r.model)
+		}
+	case len(data) == 5 && data[0] == 0x21:
+		r.address = le32(data[1:])
+		r.peek = !r.bootloader && !r.stock
+	case len(data) == 5 && data[0] == 0x41:
+		address := le32(data[1:])
+		if r.bootloader {
+			start, size := internalSector(address)
+			r.internal.erase(start, size)
+		} else {
+			r.flash.erase(address, codeplugEraseSize)
+		}
+	case len(data) == 1 && data[0] == 0x41:
+		r.internal.erase(internalFlashBase, internalFlashEnd-internalFlashBase)
+	default:
+		return fmt.Errorf("unknown control command % x", data)
+	}
+
+	return nil
+}
+
+// spi handles a download to the SPI flash block.
+func (r *Radio) spi(data []byte) error {
+	r.peek = false
+
+	switch {
+	case len(data) == 5 && data[0] == 0x01: // read
+		r.spiRead = le32(data[1:])
+	case len(data) == 5 && data[0] == 0x03: // erase
+		r.spiFlash.erase(le32(data[1:]), spiEraseSize)
+	case len(data) >= 9 && data[0] == 0x04: // write
+		address := le32(data[1:])
+		size := le32(data[5:])
+		if size != len(data)-9 {
+			return errors.New("SPI flash write size mismatch")
+		}
+		r.spiFlash.write(address, data[9:])
+	case len(data) == 1 && data[0] == 0x05: // JEDEC ID
+		r.jedec = true
+	default:
+		return fmt.Errorf("unknown SPI flash command % x", data)
+	}
+
+	return nil
+}
+
+// Upload implements dfu.Transport.
+func (r *Radio) Upload(block int, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case block == controlBlock:
+		for i := range data {
+			data[i] = 0
+		}
+		copy(data, r.command)
+	case block == spiBlock && !r.bootloader:
+		if r.jedec {
+			r.jedec = false
+			copy(data, spiFlashJEDEC)
+			break
+		}
+		if r.peek {
+			// Like md380tools' patched firmware, read memory.
+			r.internal.read(r.address, data)
+			break
+		}
+		r.spiFlash.read(r.spiRead, data)
+	case block >= flashBlock:
+		address := r.address + (block-flashBlock)*blockSize
+		if !r.bootloader {
+			r.flash.read(address, data)
+			break
+		}
+		// Like the TYT bootloader, refuse to read internal flash.
+		if r.protected || address < internalFlashEnd && address+len(data) > internalFlashBase {
+			return r.fail("Upload: read protected")
+		}
+		optionBytes := address < optionBytesAddress+optionBytesSize && address+len(data) > optionBytesAddress
+		if optionBytes != (r.alt == optionBytesAlt) {
+			return r.fail(fmt.Sprintf("Upload: 0x%08x is not served by alternate setting %d", address, r.alt))
+		}
+		r.internal.read(address, data)
+	default:
+		return r.fail(fmt.Sprintf("Upload: bad block %d", block))
+	}
+
+	r.state = stdfu.DfuReadIdle
+
+	return nil
+}
+
+// fail puts the device in the error state and returns an error.
+func (r *Radio) fail(msg string) error {
+	r.state = stdfu.DfuError
+
+	return errors.New("sim: " + msg)
+}
+
+// internalSector returns the STM32F405 flash sector containing address.
+func internalSector(address int) (start, size int) {
+	offset := address - internalFlashBase
+	switch {
+	case offset < 0x10000:
+		return internalFlashBase + offset&^0x3fff, 0x4000
+	case offset < 0x20000:
+		return internalFlashBase + 0x10000, 0x10000
+	}
+
+	return internalFlashBase + offset&^0x1ffff, 0x20000
+}
+
+func le32(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 | int(b[3])<<24
+}
+
+func fromBCD(b []byte) time.Time {
+	d := func(b byte) int {
+		return int(b>>4)*10 + int(b&0xf)
+	}
+	year := d(b[0])*100 + d(b[1])
+
+	return time.Date(year, time.Month(d(b[2])), d(b[3]), d(b[4]), d(b[5]), d(b[6]), 0, time.Local)
+}
+
+// memory is a sparse byte-addressed memory whose unwritten and erased
+// bytes read as 0xff.
+type memory map[int][]byte
+
+func (m memory) read(address int, data []byte) {
+	for i := range data {
+		page := m[(address+i)/pageSize]
+		if page == nil {
+			data[i] = 0xff
+			continue
+		}
+		data[i] = page[(address+i)%pageSize]
+	}
+}
+
+func (m memory) write(address int, data []byte) {
+	for i, b := range data {
+		n := (address + i) / pageSize
+		page := m[n]
+		if page == nil {
+			page = make([]byte, pageSize)
+			for j := range page {
+				page[j] = 0xff
+			}
+			m[n] = page
+		}
+		page[(address+i)%pageSize] = b
+	}
+}
+
+func (m memory) erase(address, size int) {
+	erased := make([]byte, size)
+	for i := range erased {
+		erased[i] = 0xff
+	}
+	m.write(address, erased)
+}
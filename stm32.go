@@ -0,0 +1,330 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dalefarnsworth-dmr/stdfu"
+)
+
+// The methods in this file work with any STM32 DfuSe bootloader,
+// including ST's system memory bootloader, not just TYT radios.
+
+// SetAddress sets the DfuSe address pointer used by subsequent reads,
+// writes and the manifestation started by LeaveDFU.
+func (dfu *Dfu) SetAddress(address int) error {
+	defer dfu.operation("SetAddress")()
+
+	err := dfu.setAddress(address)
+	if err != nil {
+		return wrapError("SetAddress", err)
+	}
+
+	return nil
+}
+
+// ErasePage erases the flash page or sector containing address.
+func (dfu *Dfu) ErasePage(address int) error {
+	defer dfu.operation("ErasePage")()
+
+	err := dfu.eraseBlock(address)
+	if err != nil {
+		return wrapError("ErasePage", err)
+	}
+
+	return nil
+}
+
+// MassErase erases all of the device's internal flash.
+func (dfu *Dfu) MassErase() error {
+	defer dfu.operation("MassErase")()
+
+	dfu.debug("mass erase")
+
+	stDfu := dfu.stDfu
+
+	err := stDfu.Dnload(controlBlock, []byte{0x41})
+	if err != nil {
+		return wrapError("MassErase", err)
+	}
+
+	// A mass erase takes seconds, during which the device is busy.
+	for {
+		dfuStatus, err := stDfu.GetStatus()
+		if err != nil {
+			return wrapError("MassErase", err)
+		}
+		if dfuStatus.State == stdfu.DfuWriteIdle {
+			break
+		}
+		if dfuStatus.State != stdfu.DfuWriteSync && dfuStatus.State != stdfu.DfuWriteBusy {
+			return errors.New("MassErase: erase failed")
+		}
+
+		err = dfu.wait()
+		if err != nil {
+			return wrapError("MassErase", err)
+		}
+	}
+
+	err = dfu.enterDfuMode()
+	if err != nil {
+		return wrapError("MassErase", err)
+	}
+
+	return nil
+}
+
+// WriteMemory erases the internal flash sectors touched by data and
+// writes data at address.  The sectors are taken from the bootloader's
+// interface string.
+func (dfu *Dfu) WriteMemory(address int, data []byte) error {
+	defer dfu.operation("WriteMemory")()
+
+	blocks, err := dfu.internalFlashBlocks()
+	if err != nil {
+		return wrapError("WriteMemory", err)
+	}
+
+	segments := []Segment{{address, data}}
+	end := address + len(data)
+	last := blocks[len(blocks)-1]
+	if address < blocks[0].address || end > last.address+last.size {
+		return fmt.Errorf("WriteMemory: 0x%08x-0x%08x is not in writable flash", address, end)
+	}
+
+	err = dfu.programSegments(alignSegments(segments, dfu.blockSize), blocks)
+	if err != nil {
+		return wrapError("WriteMemory", err)
+	}
+
+	return nil
+}
+
+// LeaveDFU leaves DFU mode and starts the code at address.
+func (dfu *Dfu) LeaveDFU(address int) error {
+	defer dfu.operation("LeaveDFU")()
+
+	err := dfu.setAddress(address)
+	if err != nil {
+		return wrapError("LeaveDFU", err)
+	}
+
+	stDfu := dfu.stDfu
+
+	// A zero-length download starts manifestation, which the device
+	// performs on the following GetStatus.
+	err = stDfu.Dnload(flashBlock, []byte{})
+	if err != nil {
+		return wrapError("LeaveDFU", err)
+	}
+
+	_, _ = stDfu.GetStatus() // the device may be gone before replying
+
+	return nil
+}
+
+// STM32F4 system memory addresses, and the DfuSe alternate setting
+// through which the option bytes are read.
+const (
+	uniqueIDAddress    = 0x1fff7a10
+	uniqueIDSize       = 12
+	optionBytesAddress = 0x1fffc000
+	optionBytesSize    = 16
+	optionBytesAlt     = 1
+)
+
+// ReadProtectedError is returned when the bootloader refuses to read
+// memory, as it does when flash read protection is enabled or the
+// address is outside the memory it serves.
+type ReadProtectedError struct {
+	Op      string
+	Address int
+}
+
+func (e *ReadProtectedError) Error() string {
+	return fmt.Sprintf("%s: memory at 0x%08x is read protected", e.Op, e.Address)
+}
+
+// ReadMemory reads size bytes of memory at address to w, where the
+// bootloader permits it.  A refusal is reported as a
+// *ReadProtectedError, after returning the bootloader to its idle
+// state.
+func (dfu *Dfu) ReadMemory(address, size int, w io.Writer) error {
+	defer dfu.operation("ReadMemory")()
+
+	err := dfu.readMemoryTo(address, size, w)
+	if err != nil {
+		if e, ok := err.(*ReadProtectedError); ok {
+			e.Op = "ReadMemory"
+			return e
+		}
+		return wrapError("ReadMemory", err)
+	}
+
+	return nil
+}
+
+// ReadUniqueDeviceID returns the MCU's 96-bit unique device ID.
+func (dfu *Dfu) ReadUniqueDeviceID() ([]byte, error) {
+	defer dfu.operation("ReadUniqueDeviceID")()
+
+	buf := bytes.NewBuffer(make([]byte, 0, uniqueIDSize))
+
+	err := dfu.ReadMemory(uniqueIDAddress, uniqueIDSize, buf)
+	if err != nil {
+		if e, ok := err.(*ReadProtectedError); ok {
+			e.Op = "ReadUniqueDeviceID"
+			return nil, e
+		}
+		return nil, wrapError("ReadUniqueDeviceID", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ReadOptionBytes returns the MCU's option bytes, read through the
+// bootloader's option bytes alternate setting.
+func (dfu *Dfu) ReadOptionBytes() ([]byte, error) {
+	defer dfu.operation("ReadOptionBytes")()
+
+	stDfu := dfu.stDfu
+	buf := bytes.NewBuffer(make([]byte, 0, optionBytesSize))
+
+	err := stDfu.SelectCurrentConfiguration(0, 0, optionBytesAlt)
+	if err != nil {
+		return nil, wrapError("ReadOptionBytes", err)
+	}
+
+	err = dfu.ReadMemory(optionBytesAddress, optionBytesSize, buf)
+	selectErr := stDfu.SelectCurrentConfiguration(0, 0, 0)
+	if err != nil {
+		if e, ok := err.(*ReadProtectedError); ok {
+			e.Op = "ReadOptionBytes"
+			return nil, e
+		}
+		return nil, wrapError("ReadOptionBytes", err)
+	}
+	if selectErr != nil {
+		return nil, wrapError("ReadOptionBytes", selectErr)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readMemoryTo reads size bytes of memory at address to iWriter, using
+// Upload requests relative to the DfuSe address pointer.
+func (dfu *Dfu) readMemoryTo(address, size int, iWriter io.Writer) error {
+	writer := bufio.NewWriter(iWriter)
+	buf := make([]byte, dfu.blockSize)
+
+	err := dfu.setAddress(address)
+	if err != nil {
+		return wrapError("readMemoryTo", err)
+	}
+
+	stDfu := dfu.stDfu
+
+	dfu.setMaxProgressCount((size + dfu.blockSize - 1) / dfu.blockSize)
+
+	for blockNumber := 0; size > 0; blockNumber++ {
+		err := dfu.progressFunc()
+		if err != nil {
+			return err
+		}
+
+		if size < len(buf) {
+			buf = buf[:size]
+		}
+
+		err = stDfu.Upload(flashBlock+blockNumber, buf)
+		if err != nil {
+			return dfu.uploadError(address+blockNumber*dfu.blockSize, err)
+		}
+
+		_, err = writer.Write(buf)
+		if err != nil {
+			return wrapError("readMemoryTo", err)
+		}
+
+		size -= len(buf)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return wrapError("readMemoryTo", err)
+	}
+
+	err = dfu.enterDfuMode()
+	if err != nil {
+		return wrapError("readMemoryTo", err)
+	}
+
+	dfu.finalProgress()
+
+	return nil
+}
+
+// uploadError returns the error to report for a failed Upload of
+// memory at address.  If the bootloader reports an error state, as it
+// does for protected memory, it is cleared and a *ReadProtectedError is
+// returned.
+func (dfu *Dfu) uploadError(address int, err error) error {
+	dfuStatus, statusErr := dfu.stDfu.GetStatus()
+	if statusErr != nil || dfuStatus.State != stdfu.DfuError {
+		return wrapError("readMemoryTo", err)
+	}
+
+	statusErr = dfu.enterDfuMode()
+	if statusErr != nil {
+		return wrapError("readMemoryTo", statusErr)
+	}
+
+	return &ReadProtectedError{
+		Op:      "readMemoryTo",
+		Address: address,
+	}
+}
+
+// internalFlashBlocks returns all erasable and writable sectors of
+// internal flash, as described by the bootloader's interface string.
+func (dfu *Dfu) internalFlashBlocks() ([]block, error) {
+	layout, err := dfu.internalFlashLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sector := range layout.Sectors {
+		if sector.Erasable && sector.Writable {
+			return layout.blocks(sector.Address)
+		}
+	}
+
+	return nil, errors.New("internalFlashBlocks: no writable sectors")
+}
@@ -0,0 +1,282 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package dfu_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// dnload is a download request made to a radio.
+type dnload struct {
+	block int
+	data  []byte
+}
+
+// recordingTransport is a radio that records the downloads made to it.
+type recordingTransport struct {
+	*sim.Radio
+	dnloads []dnload
+}
+
+func (t *recordingTransport) Dnload(block int, data []byte) error {
+	t.dnloads = append(t.dnloads, dnload{block, append([]byte{}, data...)})
+	return t.Radio.Dnload(block, data)
+}
+
+// newRecordingBootloader returns a Dfu for a simulated radio in
+// bootloader mode, and the transport recording its downloads.
+func newRecordingBootloader(t *testing.T) (*dfu.Dfu, *recordingTransport) {
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	rt := &recordingTransport{Radio: radio}
+
+	d, err := dfu.NewWithTransport(rt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.dnloads = nil
+
+	return d, rt
+}
+
+func TestSTM32Commands(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(d *dfu.Dfu) error
+		want []byte
+	}{
+		{
+			"set address",
+			func(d *dfu.Dfu) error { return d.SetAddress(0x08010000) },
+			[]byte{0x21, 0x00, 0x00, 0x01, 0x08},
+		},
+		{
+			"erase page",
+			func(d *dfu.Dfu) error { return d.ErasePage(0x08020000) },
+			[]byte{0x41, 0x00, 0x00, 0x02, 0x08},
+		},
+		{
+			"mass erase",
+			func(d *dfu.Dfu) error { return d.MassErase() },
+			[]byte{0x41},
+		},
+	}
+
+	for _, test := range tests {
+		d, rt := newRecordingBootloader(t)
+
+		err := test.run(d)
+		d.Close()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(rt.dnloads) != 1 {
+			t.Errorf("%s: %d downloads, want 1", test.name, len(rt.dnloads))
+			continue
+		}
+		got := rt.dnloads[0]
+		if got.block != 0 || !bytes.Equal(got.data, test.want) {
+			t.Errorf("%s: downloaded % x to block %d, want % x to block 0", test.name, got.data, got.block, test.want)
+		}
+	}
+}
+
+func TestWriteMemory(t *testing.T) {
+	d, rt := newRecordingBootloader(t)
+	defer d.Close()
+
+	// 3000 bytes ending past the end of the first writable sector.
+	address := 0x0800f800
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i) ^ byte(i>>8)
+	}
+
+	err := d.WriteMemory(address, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var erased [][]byte
+	written := 0
+	for _, dl := range rt.dnloads {
+		switch {
+		case dl.block == 0 && dl.data[0] == 0x41:
+			erased = append(erased, dl.data)
+		case dl.block >= 2:
+			if len(dl.data) > 1024 {
+				t.Errorf("block %d is %d bytes", dl.block, len(dl.data))
+			}
+			written += len(dl.data)
+		}
+	}
+	want := [][]byte{
+		{0x41, 0x00, 0xc0, 0x00, 0x08},
+		{0x41, 0x00, 0x00, 0x01, 0x08},
+	}
+	if len(erased) != len(want) || !bytes.Equal(erased[0], want[0]) || !bytes.Equal(erased[1], want[1]) {
+		t.Errorf("erase commands % x, want % x", erased, want)
+	}
+	if written != 3072 {
+		t.Errorf("wrote %d bytes, want 3072", written)
+	}
+
+	if !bytes.Equal(rt.InternalFlash(address, len(data)), data) {
+		t.Error("internal flash does not hold the data written")
+	}
+
+	rt.dnloads = nil
+	err = d.WriteMemory(0x080ffc00, data)
+	if err == nil {
+		t.Error("a write past the end of flash succeeded")
+	}
+	if len(rt.dnloads) != 0 {
+		t.Errorf("%d downloads for a write past the end of flash", len(rt.dnloads))
+	}
+}
+
+func TestLeaveDFU(t *testing.T) {
+	d, rt := newRecordingBootloader(t)
+	defer d.Close()
+
+	err := d.LeaveDFU(0x08000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dnload{
+		{0, []byte{0x21, 0x00, 0x00, 0x00, 0x08}},
+		{2, []byte{}},
+	}
+	if len(rt.dnloads) != len(want) {
+		t.Fatalf("%d downloads, want %d", len(rt.dnloads), len(want))
+	}
+	for i, dl := range rt.dnloads {
+		if dl.block != want[i].block || !bytes.Equal(dl.data, want[i].data) {
+			t.Errorf("download %d is % x to block %d, want % x to block %d", i, dl.data, dl.block, want[i].data, want[i].block)
+		}
+	}
+	if rt.Reboots() != 1 {
+		t.Errorf("radio rebooted %d times, want 1", rt.Reboots())
+	}
+}
+
+func TestReadMemoryProtected(t *testing.T) {
+	radio := sim.New("MD380")
+	radio.SetBootloader(true)
+	radio.SetReadProtected(true)
+
+	d, err := dfu.NewWithTransport(radio, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var buf bytes.Buffer
+	err = d.ReadMemory(0x1fff7a10, 12, &buf)
+	e, ok := err.(*dfu.ReadProtectedError)
+	if !ok {
+		t.Fatalf("got error %v, want a *ReadProtectedError", err)
+	}
+	if e.Op != "ReadMemory" || e.Address != 0x1fff7a10 {
+		t.Errorf("got %+v, want ReadMemory at 0x1fff7a10", e)
+	}
+
+	// The bootloader is left ready for the next request.
+	radio.SetReadProtected(false)
+	buf.Reset()
+	err = d.ReadMemory(0x1fff7a10, 12, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "SIM-MD380\x00\x00\x00" {
+		t.Errorf("read %q", buf.String())
+	}
+}
+
+// selectFailingTransport is a radio that fails to select alternate
+// setting alt.
+type selectFailingTransport struct {
+	*sim.Radio
+	alt int
+}
+
+func (t selectFailingTransport) SelectCurrentConfiguration(config, iface, altSetting int) error {
+	if altSetting == t.alt {
+		return errors.New("select failed")
+	}
+	return t.Radio.SelectCurrentConfiguration(config, iface, altSetting)
+}
+
+func TestReadOptionBytes(t *testing.T) {
+	optionBytes := []byte{
+		0xec, 0xaa, 0xff, 0x0f, 0x13, 0x55, 0x00, 0xf0,
+		0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
+	}
+
+	tests := []struct {
+		name      string
+		failAlt   int
+		protected bool
+		wantError bool
+	}{
+		{"read", -1, false, false},
+		{"select option bytes fails", 1, false, true},
+		{"select flash fails", 0, false, true},
+		{"read protected", -1, true, true},
+	}
+
+	for _, test := range tests {
+		radio := sim.New("MD380")
+		radio.SetBootloader(true)
+		radio.SetOptionBytes(optionBytes)
+		radio.SetReadProtected(test.protected)
+
+		d, err := dfu.NewWithTransport(selectFailingTransport{radio, test.failAlt}, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		data, err := d.ReadOptionBytes()
+		d.Close()
+		if (err != nil) != test.wantError {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantError)
+			continue
+		}
+		_, ok := err.(*dfu.ReadProtectedError)
+		if ok != test.protected {
+			t.Errorf("%s: got error %v, want a *ReadProtectedError %v", test.name, err, test.protected)
+		}
+		if err == nil && !bytes.Equal(data, optionBytes) {
+			t.Errorf("%s: read % x, want % x", test.name, data, optionBytes)
+		}
+	}
+}
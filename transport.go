@@ -0,0 +1,93 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"github.com/dalefarnsworth-dmr/stdfu"
+)
+
+// Transport carries DFU requests to a device.  It is implemented for
+// USB devices by the stdfu package, or with gousb for a radio chosen by
+// Open, and may be implemented by other means, such as a simulated
+// radio, for use with NewWithTransport.
+type Transport interface {
+	Close()
+	Detach() error
+	Dnload(block int, data []byte) error
+	Upload(block int, data []byte) error
+	GetStatus() (stdfu.DfuStatus, error)
+	ClrStatus() error
+	GetState() (stdfu.State, error)
+	Abort() error
+	GetStringDescriptor(index int) (string, error)
+	SelectCurrentConfiguration(config, iface, altSetting int) error
+}
+
+// InterfaceDescriber is implemented by a Transport that can read the
+// string describing an interface alternate setting, its iInterface
+// string.  A DfuSe bootloader describes the memory behind each
+// alternate setting in that string.  An empty string means the
+// alternate setting has none.
+type InterfaceDescriber interface {
+	InterfaceDescription(iface, altSetting int) (string, error)
+}
+
+// Simulator is implemented by a Transport to a simulated device, which
+// carries out each request at once.  The delays a real radio needs,
+// such as while it erases flash, are skipped for such a Transport.
+type Simulator interface {
+	Simulated() bool
+}
+
+// stdfuTransport adapts a *stdfu.StDfu to Transport.
+type stdfuTransport struct {
+	*stdfu.StDfu
+}
+
+// NewWithTransport returns a Dfu that communicates with a radio through
+// t, in the same way as New does with the first attached radio.
+func NewWithTransport(t Transport, progressCallback func(progressCounter int) error) (*Dfu, error) {
+	dfu := &Dfu{
+		progressCallback: progressCallback,
+		progressFunc:     func() error { return nil },
+		logger:           defaultLogger,
+		trace:            defaultTrace,
+	}
+	dfu.setTransport(t)
+
+	err := dfu.enterDfuMode()
+	if err != nil {
+		dfu.Close()
+		return nil, err
+	}
+
+	dfu.blockSize = 1024
+	dfu.eraseBlockSize = 64 * 1024
+
+	dfu.serial, _ = t.GetStringDescriptor(usbSerialNumberIndex)
+	mfg, _ := t.GetStringDescriptor(1)
+	dfu.bootloader = mfg == bootloaderManufacturer
+
+	return dfu, nil
+}
@@ -0,0 +1,310 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventKind identifies the kind of a watcher event.
+type EventKind int
+
+const (
+	RadioArrived  EventKind = iota // a radio was attached or changed mode
+	RadioDeparted                  // a radio was detached or changed mode
+	JobFinished                    // a queued job finished, see Event.Err
+	WatchFailed                    // listing the radios failed, see Event.Err
+)
+
+func (kind EventKind) String() string {
+	switch kind {
+	case RadioArrived:
+		return "arrived"
+	case RadioDeparted:
+		return "departed"
+	case JobFinished:
+		return "job finished"
+	case WatchFailed:
+		return "watch failed"
+	}
+
+	return fmt.Sprintf("EventKind(%d)", int(kind))
+}
+
+// Event reports a change seen by a Watcher.
+type Event struct {
+	Kind     EventKind
+	Device   *DeviceInfo
+	Model    string // the radio's model, if it could be read
+	UniqueID string // see UniqueID, if it could be read
+	Err      error
+}
+
+// A WatchJob is run on an arriving radio by a Watcher.
+type WatchJob func(d *Dfu, ev *Event) error
+
+// Watcher polls for radios arriving and departing.
+type Watcher struct {
+	// Interval is the time between polls.  If zero, one second is used.
+	Interval time.Duration
+
+	// List lists the attached radios.  If nil, List is used.
+	List func() ([]*DeviceInfo, error)
+
+	// Open opens a radio.  If nil, Open is used.
+	Open func(selector string, progressCallback func(progressCounter int) error) (*Dfu, error)
+
+	// Identify arranges for arriving radios to be opened to read their
+	// model and unique ID.
+	Identify bool
+
+	// Progress, if not nil, is the progress callback for queued jobs.
+	Progress func(ev *Event, progressCounter int) error
+
+	mu   sync.Mutex
+	jobs []WatchJob
+	done map[string]bool // the UniqueIDs of radios that have had a job, in each form
+	busy map[string]bool // the paths of radios running a job
+}
+
+// Enqueue queues job to be run on the next arriving radio that has
+// not already had a job.  Radios are recognized by their UniqueID.  A
+// radio whose firmware cannot report the MCU's unique device ID, as
+// stock firmware cannot, is identified by a fingerprint of its USB
+// serial number instead, so the fingerprint of each serial number a
+// radio reports while its job runs is recorded along with its
+// UniqueID.  A radio that restarts after its job, in either mode,
+// therefore does not take another, unless its bootloader and firmware
+// report different serial numbers.  Queued jobs are only run when
+// Identify is set, and only on radios whose UniqueID can be read.
+func (w *Watcher) Enqueue(job WatchJob) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.jobs = append(w.jobs, job)
+}
+
+// Pending returns the number of queued jobs not yet started.
+func (w *Watcher) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.jobs)
+}
+
+// watchKey distinguishes the same radio in different modes, so that a
+// change of mode is reported as a departure and an arrival.
+func watchKey(info *DeviceInfo) string {
+	return fmt.Sprintf("%s/%s/%t", info.Path, info.Serial, info.Bootloader)
+}
+
+// Watch polls for radios until ctx is canceled, sending events to
+// events.  Radios attached when Watch is called are reported as
+// arriving.  Radios running a queued job are not reported until the
+// job finishes.
+func (w *Watcher) Watch(ctx context.Context, events chan<- *Event) error {
+	interval := w.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	list := w.List
+	if list == nil {
+		list = List
+	}
+
+	w.mu.Lock()
+	if w.done == nil {
+		w.done = make(map[string]bool)
+		w.busy = make(map[string]bool)
+	}
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	send := func(ev *Event) {
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+		}
+	}
+
+	present := make(map[string]*Event)
+	for {
+		infos, err := list()
+		if err != nil {
+			send(&Event{Kind: WatchFailed, Err: err})
+		} else {
+			seen := make(map[string]bool)
+			for _, info := range infos {
+				key := watchKey(info)
+				seen[key] = true
+				if present[key] != nil || w.isBusy(info.Path) {
+					continue
+				}
+
+				ev := &Event{Kind: RadioArrived, Device: info}
+				if w.Identify {
+					w.identify(ev)
+				}
+				present[key] = ev
+				send(ev)
+
+				job := w.nextJob(ev)
+				if job != nil {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						send(w.runJob(job, ev))
+					}()
+				}
+			}
+
+			for key, ev := range present {
+				if !seen[key] && !w.isBusy(ev.Device.Path) {
+					delete(present, key)
+					send(&Event{
+						Kind:     RadioDeparted,
+						Device:   ev.Device,
+						Model:    ev.Model,
+						UniqueID: ev.UniqueID,
+					})
+				}
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *Watcher) open(selector string, progressCallback func(int) error) (*Dfu, error) {
+	if w.Open != nil {
+		return w.Open(selector, progressCallback)
+	}
+	return Open(selector, progressCallback)
+}
+
+// identify fills in the model and unique ID of the radio in ev.
+func (w *Watcher) identify(ev *Event) {
+	d, err := w.open(ev.Device.Path, nil)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	ev.UniqueID, _ = d.UniqueID()
+	if !ev.Device.Bootloader {
+		profile, err := d.Profile()
+		if err == nil {
+			ev.Model = profile.Name
+		}
+	}
+}
+
+func (w *Watcher) isBusy(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.busy[path]
+}
+
+// nextJob returns the next queued job for the radio in ev, if any,
+// marking the radio busy.
+func (w *Watcher) nextJob(ev *Event) WatchJob {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.jobs) == 0 || ev.UniqueID == "" || w.done[ev.UniqueID] {
+		return nil
+	}
+
+	job := w.jobs[0]
+	w.jobs = w.jobs[1:]
+	w.done[ev.UniqueID] = true
+	if ev.Device.Serial != "" {
+		w.done[serialFingerprint(ev.Device.Serial)] = true
+	}
+	w.busy[ev.Device.Path] = true
+
+	return job
+}
+
+// runJob runs job on the radio in ev and returns a JobFinished event.
+func (w *Watcher) runJob(job WatchJob, ev *Event) *Event {
+	defer func() {
+		w.mu.Lock()
+		delete(w.busy, ev.Device.Path)
+		w.mu.Unlock()
+	}()
+
+	var progressCallback func(int) error
+	if w.Progress != nil {
+		progressCallback = func(progressCounter int) error {
+			return w.Progress(ev, progressCounter)
+		}
+	}
+
+	finished := &Event{
+		Kind:     JobFinished,
+		Device:   ev.Device,
+		Model:    ev.Model,
+		UniqueID: ev.UniqueID,
+	}
+
+	d, err := w.open(ev.Device.Path, progressCallback)
+	if err != nil {
+		finished.Err = err
+		return finished
+	}
+	defer d.Close()
+
+	// The job may restart the radio in another mode, where it reports
+	// another serial number or UniqueID.
+	w.setDone(d)
+	finished.Err = job(d, ev)
+	w.setDone(d)
+
+	return finished
+}
+
+// setDone records the forms of UniqueID known to d, so that its radio
+// does not take another job when it returns in the other mode.
+func (w *Watcher) setDone(d *Dfu) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if d.uniqueID != "" {
+		w.done[d.uniqueID] = true
+	}
+	if d.serial != "" {
+		w.done[serialFingerprint(d.serial)] = true
+	}
+}
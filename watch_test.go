@@ -0,0 +1,152 @@
+// Copyright 2017-2019 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// This file is part of Dfu.
+//
+// Dfu is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU Lesser General Public
+// License as published by the Free Software Foundation.
+//
+// Dfu is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Dfu.  If not, see <http://www.gnu.org/licenses/>.
+
+package dfu_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dalefarnsworth-dmr/dfu"
+	"github.com/dalefarnsworth-dmr/dfu/sim"
+)
+
+// testBus is a USB bus of simulated radios for a Watcher.
+type testBus struct {
+	mu     sync.Mutex
+	radios map[string]*sim.Radio // by path
+	boot   map[string]bool
+}
+
+func (b *testBus) attach(path string, radio *sim.Radio, bootloader bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	radio.SetBootloader(bootloader)
+	b.radios[path] = radio
+	b.boot[path] = bootloader
+}
+
+func (b *testBus) list() ([]*dfu.DeviceInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var infos []*dfu.DeviceInfo
+	for path := range b.radios {
+		infos = append(infos, &dfu.DeviceInfo{
+			Path:       path,
+			Bootloader: b.boot[path],
+		})
+	}
+
+	return infos, nil
+}
+
+func (b *testBus) open(path string, progressCallback func(int) error) (*dfu.Dfu, error) {
+	b.mu.Lock()
+	radio := b.radios[path]
+	b.mu.Unlock()
+
+	return dfu.NewWithTransport(radio, progressCallback)
+}
+
+func TestWatcherModeChange(t *testing.T) {
+	// With stock firmware the radio reports a fingerprint of its
+	// serial number in application mode, in place of the unique
+	// device ID it reported in bootloader mode.
+	for _, stock := range []bool{false, true} {
+		testWatcherModeChange(t, stock)
+	}
+}
+
+func testWatcherModeChange(t *testing.T, stock bool) {
+	bus := &testBus{
+		radios: make(map[string]*sim.Radio),
+		boot:   make(map[string]bool),
+	}
+	w := &dfu.Watcher{
+		Interval: 10 * time.Millisecond,
+		List:     bus.list,
+		Open:     bus.open,
+		Identify: true,
+	}
+
+	jobs := make(chan string, 3)
+	for i := 0; i < 2; i++ {
+		w.Enqueue(func(d *dfu.Dfu, ev *dfu.Event) error {
+			jobs <- ev.UniqueID
+			return nil
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan *dfu.Event, 100)
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx, events)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	radio := sim.New("MD380")
+	radio.SetUniqueID([]byte("unit-0000001"))
+	bus.attach("1-1", radio, true)
+
+	var first string
+	select {
+	case first = <-jobs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stock firmware %t: no job ran on the arriving radio", stock)
+	}
+
+	// The radio restarts in application mode, at another address.
+	radio.SetStockFirmware(stock)
+	bus.mu.Lock()
+	delete(bus.radios, "1-1")
+	bus.mu.Unlock()
+	bus.attach("1-2", radio, false)
+
+	select {
+	case id := <-jobs:
+		t.Fatalf("stock firmware %t: radio %s took a second job after changing mode", stock, id)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	other := sim.New("MD380")
+	other.SetSerial("SIMOTHER")
+	other.SetUniqueID([]byte("unit-0000002"))
+	bus.attach("1-3", other, false)
+
+	select {
+	case id := <-jobs:
+		if id == first {
+			t.Errorf("stock firmware %t: second job ran on %s again", stock, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stock firmware %t: no job ran on the second radio", stock)
+	}
+}